@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/cockroachlabs/example-app-go-gorm/store"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Insert random accounts, and print their IDs one per line
+// Unlike `demo`, the accounts are kept, so that the other commands can use them
+func runInsert(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("insert", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	numAccts := fs.Int("rows", 5, "number of accounts to insert (must be positive)")
+	batchSize := fs.Int("batch-size", 1000, "number of accounts to insert per INSERT statement (must be positive)")
+	seed := fs.Int64("seed", 0, "seed for the random number generator, to reproduce a run (0 means a time-based seed)")
+	minBalance := fs.Int("min-balance", 100, "lowest initial balance in whole dollars (must not be negative)")
+	maxBalance := fs.Int("max-balance", 10100, "upper bound, exclusive, of the initial balances in whole dollars (must be greater than -min-balance)")
+	overdraftLimit := fs.Int("overdraft-limit", 0, "amount in whole dollars by which each new account may be overdrawn (must not be negative)")
+	progressEvery := fs.Int("progress-every", 1000, "log the number of accounts inserted each time it passes a multiple of this, checked after every -batch-size rows (0 disables)")
+	dryRun := fs.Bool("dry-run", false, "print the SQL that would insert the accounts without running it")
+	names := fs.String("names", "alice,bob,carol,dave,erin", "comma-separated names of the new accounts, in order (accounts beyond the list get generated labels)")
+	fs.Parse(args)
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+	if *numAccts <= 0 {
+		return fmt.Errorf("invalid -rows value %d: the number of accounts must be positive", *numAccts)
+	}
+	if *batchSize <= 0 {
+		return fmt.Errorf("invalid -batch-size value %d: the batch size must be positive", *batchSize)
+	}
+	if *minBalance < 0 {
+		return fmt.Errorf("invalid -min-balance value %d: the balance must not be negative", *minBalance)
+	}
+	if *maxBalance <= *minBalance {
+		return fmt.Errorf("invalid -max-balance value %d: must be greater than -min-balance (%d)", *maxBalance, *minBalance)
+	}
+	if *overdraftLimit < 0 {
+		return fmt.Errorf("invalid -overdraft-limit value %d: the limit must not be negative", *overdraftLimit)
+	}
+	for _, f := range []struct {
+		name    string
+		dollars int
+	}{{"min-balance", *minBalance}, {"max-balance", *maxBalance}, {"overdraft-limit", *overdraftLimit}} {
+		if err := checkDollars(f.name, f.dollars); err != nil {
+			return err
+		}
+	}
+	if *progressEvery < 0 {
+		return fmt.Errorf("invalid -progress-every value %d: the number of rows must not be negative", *progressEvery)
+	}
+	rng := newRand(*seed)
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+	if err := migrate(ctx, db, conn.retry(), *conn.uuidFunction, *conn.noMigrate); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		db = db.Session(&gorm.Session{DryRun: true, Logger: conn.gormLogger.LogMode(logger.Info)})
+	}
+	// `Create` wraps the inserts in `store.ExecuteTx`, which retries them
+	accounts := store.NewAccounts(rng, *numAccts, *minBalance, *maxBalance, *overdraftLimit, accountNames(*names))
+	accountStore := store.NewGormAccountStore(db)
+	accountStore.BatchSize = *batchSize
+	accountStore.ProgressEvery = *progressEvery
+	if _, err := accountStore.Create(ctx, accounts); err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		fmt.Println(account.ID)
+	}
+	return nil
+}
+
+// Transfer funds between two existing accounts
+func runTransfer(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("transfer", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	from := fs.String("from", "", "UUID of the account to take the funds from (required)")
+	to := fs.String("to", "", "UUID of the account to give the funds to (required)")
+	transferAmt := fs.Int("amount", 100, "amount in whole dollars to transfer (must be positive)")
+	percent := fs.Float64("percent", 0, "transfer this percentage of the source balance, read in the transaction, instead of -amount (0 uses -amount)")
+	key := fs.String("key", "", "idempotency key of the transfer, so that running the same command again is safe (defaults to a random key)")
+	dryRun := fs.Bool("dry-run", false, "print the SQL that would transfer the funds without running it")
+	explain := fs.Bool("explain", false, "print CockroachDB's query plan for each statement of the transfer, without running it")
+	singleStatement := fs.Bool("single-statement", false, "transfer with one UPDATE ... RETURNING statement, in a single round trip, instead of reading the accounts first")
+	isolation := addIsolationFlag(fs)
+	balanceCap := addBalanceCapFlag(fs)
+	fs.Parse(args)
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+	maxBalance, err := parseBalanceCap(*balanceCap)
+	if err != nil {
+		return err
+	}
+	fromID, err := parseAccountID("from", *from)
+	if err != nil {
+		return err
+	}
+	toID, err := parseAccountID("to", *to)
+	if err != nil {
+		return err
+	}
+	if *transferAmt <= 0 {
+		return fmt.Errorf("invalid -amount value %d: the transfer amount must be positive", *transferAmt)
+	}
+	if err := checkDollars("amount", *transferAmt); err != nil {
+		return err
+	}
+	if *percent < 0 || *percent > 100 {
+		return fmt.Errorf("invalid -percent value %v: must be greater than 0 and at most 100", *percent)
+	}
+	// A dry run reads no balance to take the percentage of
+	if *percent > 0 && (*dryRun || *explain) {
+		return errors.New("-percent cannot be combined with -dry-run or -explain")
+	}
+	// The percentage is of a balance read before the transfer, which is the
+	// round trip that -single-statement saves, and -explain only plans the
+	// statements of the usual transfer
+	if *singleStatement && (*percent > 0 || *explain) {
+		return errors.New("-single-statement cannot be combined with -percent or -explain")
+	}
+	if *key == "" {
+		*key = uuid.NewString()
+	}
+	txOpts, err := txOptions(*isolation)
+	if err != nil {
+		return err
+	}
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+	if err := migrate(ctx, db, conn.retry(), *conn.uuidFunction, *conn.noMigrate); err != nil {
+		return err
+	}
+
+	if *explain {
+		return store.ExplainTransfer(ctx, db, fromID, toID, model.Dollars(*transferAmt))
+	}
+	if *dryRun {
+		db = db.Session(&gorm.Session{DryRun: true, Logger: conn.gormLogger.LogMode(logger.Info)})
+	}
+	// For information and reference documentation, see:
+	//   https://www.cockroachlabs.com/docs/stable/error-handling-and-troubleshooting.html
+	// With -percent, the amount depends on the balance read by each attempt
+	_, err = store.ExecuteTransfer(ctx, db, txOpts,
+		func(tx *gorm.DB) error {
+			if *percent > 0 {
+				_, err := store.TransferPercent(ctx, tx, *key, fromID, toID, *percent, maxBalance)
+				return err
+			}
+			if *singleStatement {
+				return store.TransferFundsReturning(ctx, tx, *key, fromID, toID, model.Dollars(*transferAmt), maxBalance)
+			}
+			return store.TransferFunds(ctx, tx, *key, fromID, toID, model.Dollars(*transferAmt), maxBalance)
+		},
+	)
+	return err
+}
+
+// Add interest to the balance of every account with a positive balance, and
+// print the total interest
+func runAccrue(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("accrue", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	rate := fs.Float64("rate", 0.05, "interest rate to apply, e.g. 0.05 for 5% (must be positive)")
+	balanceCap := addBalanceCapFlag(fs)
+	fs.Parse(args)
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+	maxBalance, err := parseBalanceCap(*balanceCap)
+	if err != nil {
+		return err
+	}
+	if !(*rate > 0) {
+		return fmt.Errorf("invalid -rate value %v: the interest rate must be positive", *rate)
+	}
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+	if err := migrate(ctx, db, conn.retry(), *conn.uuidFunction, *conn.noMigrate); err != nil {
+		return err
+	}
+
+	// For information and reference documentation, see:
+	//   https://www.cockroachlabs.com/docs/stable/error-handling-and-troubleshooting.html
+	var interest model.Money
+	if _, err := store.ExecuteTx(ctx, db, nil,
+		func(tx *gorm.DB) error {
+			var err error
+			interest, err = store.Accrue(ctx, tx, *rate, maxBalance)
+			return err
+		},
+	); err != nil {
+		return err
+	}
+	fmt.Printf("Interest applied: %s\n", interest)
+	return nil
+}
+
+// Print the IDs and balances of the accounts
+func runList(ctx context.Context, args []string) (err error) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	limit := fs.Int("limit", 0, "maximum number of accounts to print (0 means all)")
+	offset := fs.Int("offset", 0, "number of accounts, ordered by ID, to skip before printing")
+	asOf := fs.Duration("as-of", 0, "print balances as they were this long ago, e.g. 10s, using AS OF SYSTEM TIME (0 reads current balances)")
+	changedSince := fs.Duration("changed-since", 0, "print only the accounts updated within this long, e.g. 5m (0 prints all)")
+	output := fs.String("output", "text", "format of the printout on stdout: text or json")
+	batchSize := fs.Int("batch-size", 1000, "number of accounts to read per query (must be positive)")
+	fs.Parse(args)
+	defer func() { err = forOutput(err, *output) }()
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+	if *limit < 0 {
+		return fmt.Errorf("invalid -limit value %d: the limit must not be negative", *limit)
+	}
+	if *offset < 0 {
+		return fmt.Errorf("invalid -offset value %d: the offset must not be negative", *offset)
+	}
+	if *asOf < 0 {
+		return fmt.Errorf("invalid -as-of value %s: the duration must not be negative", *asOf)
+	}
+	if *changedSince < 0 {
+		return fmt.Errorf("invalid -changed-since value %s: the duration must not be negative", *changedSince)
+	}
+	if err := validateOutput(*output); err != nil {
+		return err
+	}
+	if *batchSize <= 0 {
+		return fmt.Errorf("invalid -batch-size value %d: the batch size must be positive", *batchSize)
+	}
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+
+	return store.PrintBalances(ctx, db, store.ListOptions{Limit: *limit, Offset: *offset, AsOf: *asOf, ChangedSince: *changedSince}, *output, *batchSize)
+}
+
+// Print the accounts with the highest, or lowest, balances
+func runTop(ctx context.Context, args []string) (err error) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	n := fs.Int("n", 10, "number of accounts to print (must be positive)")
+	asc := fs.Bool("asc", false, "print the lowest balances instead of the highest")
+	output := fs.String("output", "text", "format of the printout on stdout: text or json")
+	fs.Parse(args)
+	defer func() { err = forOutput(err, *output) }()
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+	if *n <= 0 {
+		return fmt.Errorf("invalid -n value %d: the number of accounts must be positive", *n)
+	}
+	if err := validateOutput(*output); err != nil {
+		return err
+	}
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+
+	return store.PrintTopAccounts(ctx, db, *n, *asc, *output)
+}
+
+// Print the number of accounts and their total balance
+func runStats(ctx context.Context, args []string) (err error) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	output := fs.String("output", "text", "format of the printout on stdout: text or json")
+	fs.Parse(args)
+	defer func() { err = forOutput(err, *output) }()
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+	if err := validateOutput(*output); err != nil {
+		return err
+	}
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+
+	stats, err := store.AccountStats(ctx, db)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(stats)
+	}
+	fmt.Printf("Accounts: %d\nTotal balance: %s\n", stats.Accounts, stats.TotalBalance)
+	return nil
+}
+
+// Check for accounts overdrawn beyond their limit, and fail if there are any
+func runReconcile(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	fs.Parse(args)
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+
+	accounts, err := store.OverdrawnAccounts(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(accounts) == 0 {
+		fmt.Println("No anomalies found")
+		return nil
+	}
+	fmt.Println("Accounts overdrawn beyond their limit:")
+	for _, account := range accounts {
+		fmt.Printf("%s %-12s %s (limit %s)\n", account.ID, account.Name, account.Balance, account.OverdraftLimit)
+	}
+	return fmt.Errorf("found %d accounts overdrawn beyond their limit", len(accounts))
+}
+
+// Check that the tables match the models, without migrating them, and fail
+// if they do not
+func runVerifySchema(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("verify-schema", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	fs.Parse(args)
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+
+	drift, err := verifySchema(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(drift) == 0 {
+		fmt.Println("The schema matches the models")
+		return nil
+	}
+	fmt.Println("Schema drift:")
+	for _, d := range drift {
+		fmt.Println(d)
+	}
+	return fmt.Errorf("found %d differences between the schema and the models", len(drift))
+}
+
+// Print the balance of a single account, without touching any other rows
+func runBalance(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("balance", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	fs.Parse(args)
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+	if fs.NArg() != 1 {
+		return errors.New("balance takes exactly one account UUID")
+	}
+	id, err := uuid.Parse(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid account ID %q: %w", fs.Arg(0), err)
+	}
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+
+	account, err := store.NewGormAccountStore(db).GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	fmt.Println(account.Balance)
+	return nil
+}
+
+// Delete the accounts given by UUID, along with the customers that own them
+func runDelete(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	hardDelete := fs.Bool("hard", false, "permanently remove the accounts instead of soft-deleting them")
+	fs.Parse(args)
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+	if fs.NArg() == 0 {
+		return errors.New("delete takes the UUIDs of the accounts to delete")
+	}
+	acctIDs := make([]uuid.UUID, fs.NArg())
+	for i, arg := range fs.Args() {
+		id, err := uuid.Parse(arg)
+		if err != nil {
+			return fmt.Errorf("invalid account ID %q: %w", arg, err)
+		}
+		acctIDs[i] = id
+	}
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+
+	// `DeleteByIDs` wraps the deletes in `store.ExecuteTx`, which retries
+	// them. For information and reference documentation, see:
+	//   https://www.cockroachlabs.com/docs/stable/error-handling-and-troubleshooting.html
+	_, err = store.NewGormAccountStore(db).DeleteByIDs(ctx, acctIDs, *hardDelete)
+	return err
+}
+
+// Export the ID and balance of every account to a CSV file, without changing
+// the accounts table
+func runExport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	batchSize := fs.Int("batch-size", 1000, "number of accounts to read per query (must be positive)")
+	fs.Parse(args)
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+	if fs.NArg() != 1 {
+		return errors.New("export takes exactly one CSV file path")
+	}
+	if *batchSize <= 0 {
+		return fmt.Errorf("invalid -batch-size value %d: the batch size must be positive", *batchSize)
+	}
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+
+	return store.ExportCSV(ctx, db, fs.Arg(0), *batchSize)
+}
+
+// Serve the accounts over HTTP until the program is interrupted
+func runServe(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	addr := fs.String("addr", ":8080", "address to serve the REST API on")
+	isolation := addIsolationFlag(fs)
+	balanceCap := addBalanceCapFlag(fs)
+	fs.Parse(args)
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+	maxBalance, err := parseBalanceCap(*balanceCap)
+	if err != nil {
+		return err
+	}
+	txOpts, err := txOptions(*isolation)
+	if err != nil {
+		return err
+	}
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	// The server runs until the program is interrupted, so only the
+	// migration gets the time limit, and each request gets its own
+	migrateCtx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+	if err := migrate(migrateCtx, db, conn.retry(), *conn.uuidFunction, *conn.noMigrate); err != nil {
+		return err
+	}
+
+	accounts := store.NewGormAccountStore(db)
+	accounts.MaxBalance = maxBalance
+	return serve(ctx, accounts, *addr, *conn.timeout, txOpts)
+}
+
+// Check connectivity without touching the accounts table, and print the
+// CockroachDB version
+func runPing(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	fs.Parse(args)
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+
+	db, closeDB, err := conn.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+
+	version, err := ping(ctx, db)
+	if err != nil {
+		return err
+	}
+	fmt.Println(version)
+	return nil
+}
+
+// Print the version, git commit, and build date
+func runVersion(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Parse(args)
+
+	fmt.Printf("example-app-go-gorm %s (commit %s, built %s)\n", version, commit, date)
+	return nil
+}
+
+// Parse the account UUID given with the flag `name`, which is required
+func parseAccountID(name string, value string) (uuid.UUID, error) {
+	if value == "" {
+		return uuid.Nil, fmt.Errorf("-%s is required", name)
+	}
+	id, err := uuid.Parse(value)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid -%s value %q: %w", name, value, err)
+	}
+	return id, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings that can be read from the file named by the
+// `-config` flag, e.g.
+//
+//	dsn: postgresql://root@localhost:26257/bank?sslmode=disable
+//	rows: 1000
+//	amount: 50
+//	max_open_conns: 40
+//	max_idle_conns: 40
+//	conn_max_lifetime: 10m
+//	log_level: debug
+//
+// Every field stands for the flag of the same name, and a flag given on the
+// command line overrides the value from the file. A field left out of the
+// file keeps the flag's default. Settings that the command does not have,
+// like `rows` for `list`, are ignored
+type Config struct {
+	// The connection string, as for `-dsn`
+	DSN string `yaml:"dsn"`
+	// The number of accounts to insert, as for `-rows`
+	Rows int `yaml:"rows"`
+	// The amount in whole dollars to transfer, as for `-amount`
+	Amount int `yaml:"amount"`
+	// The connection pool settings, as for `-max-open-conns`,
+	// `-max-idle-conns`, and `-conn-max-lifetime`. They are pointers, since
+	// 0 is a meaningful value for each of them
+	MaxOpenConns    *int           `yaml:"max_open_conns"`
+	MaxIdleConns    *int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime *time.Duration `yaml:"conn_max_lifetime"`
+	// The minimum level of log messages, as for `-log-level`
+	LogLevel string `yaml:"log_level"`
+}
+
+// Read the YAML configuration file at `path`
+// Unknown settings are reported as errors, so that a misspelled name is not
+// silently ignored
+func loadConfig(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("reading config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return config, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Set the flags of `fs` to the values in `config`, except for the flags that
+// were given on the command line
+func (config Config) apply(fs *flag.FlagSet) error {
+	values := map[string]string{}
+	if config.DSN != "" {
+		values["dsn"] = config.DSN
+	}
+	if config.Rows != 0 {
+		values["rows"] = strconv.Itoa(config.Rows)
+	}
+	if config.Amount != 0 {
+		values["amount"] = strconv.Itoa(config.Amount)
+	}
+	if config.MaxOpenConns != nil {
+		values["max-open-conns"] = strconv.Itoa(*config.MaxOpenConns)
+	}
+	if config.MaxIdleConns != nil {
+		values["max-idle-conns"] = strconv.Itoa(*config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime != nil {
+		values["conn-max-lifetime"] = config.ConnMaxLifetime.String()
+	}
+	if config.LogLevel != "" {
+		values["log-level"] = config.LogLevel
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, value := range values {
+		if fs.Lookup(name) == nil || explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid config file value for %s: %w", name, err)
+		}
+	}
+	return nil
+}
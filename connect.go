@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// Resolve the connection string and report where it came from
+// The `-dsn` flag takes precedence over the file named by `-dsn-file`, which in
+// turn takes precedence over the DATABASE_URL environment variable. Without
+// any of them, a connection string is built from `parts` if it has a host.
+// The user is only prompted on stdin when none of them is set
+func connectionString(dsnFlag string, dsnFile string, parts dsnParts) (string, string, error) {
+	if dsnFlag != "" {
+		return os.ExpandEnv(dsnFlag), "flag", nil
+	}
+	if dsnFile != "" {
+		contents, err := os.ReadFile(dsnFile)
+		if err != nil {
+			return "", "", fmt.Errorf("reading connection string file: %w", err)
+		}
+		return os.ExpandEnv(strings.TrimSpace(string(contents))), "file", nil
+	}
+	if envDSN := os.Getenv("DATABASE_URL"); envDSN != "" {
+		return os.ExpandEnv(envDSN), "env", nil
+	}
+	if parts.Host != "" {
+		return buildDSN(parts), "host", nil
+	}
+	fmt.Print("Enter a connection string: ")
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", "", err
+		}
+		return "", "", errors.New("no connection string provided")
+	}
+	return os.ExpandEnv(strings.TrimSpace(scanner.Text())), "prompt", nil
+}
+
+// The parts of a connection string from the `-host`, `-port`, `-user`,
+// `-password`, and `-dbname` flags
+type dsnParts struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	DBName   string
+}
+
+// Build a URL connection string, such as
+// "postgresql://root@localhost:26257/defaultdb", from `parts`
+// Characters that are special in a URL are percent-encoded, so the password
+// may contain any of them
+func buildDSN(parts dsnParts) string {
+	u := url.URL{
+		Scheme: "postgresql",
+		User:   url.User(parts.User),
+		Host:   net.JoinHostPort(parts.Host, strconv.Itoa(parts.Port)),
+		Path:   "/" + parts.DBName,
+	}
+	if parts.Password != "" {
+		u.User = url.UserPassword(parts.User, parts.Password)
+	}
+	return u.String()
+}
+
+// The TLS settings from the `-sslmode`, `-sslrootcert`, `-sslcert`, and
+// `-sslkey` flags. An empty field leaves the setting to the connection string
+type tlsOptions struct {
+	Mode     string
+	RootCert string
+	Cert     string
+	Key      string
+}
+
+// The values libpq, and so the postgres driver, accepts for "sslmode"
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// Check that the TLS flags are valid and can be used together
+// A client certificate is useless without its private key, and the other way
+// around, so `-sslcert` and `-sslkey` must be set together
+func (o tlsOptions) validate() error {
+	if o.Mode != "" && !slices.Contains(sslModes, o.Mode) {
+		return fmt.Errorf("invalid -sslmode value %q: must be one of %s", o.Mode, strings.Join(sslModes, ", "))
+	}
+	if (o.Cert == "") != (o.Key == "") {
+		return errors.New("-sslcert and -sslkey must be set together")
+	}
+	return nil
+}
+
+// Add the TLS settings in `opts` to the connection string `dsn`
+// A setting the connection string already has is left alone, so a
+// hand-written connection string always takes precedence over the flags
+func withTLS(dsn string, opts tlsOptions) (string, error) {
+	if opts == (tlsOptions{}) {
+		return dsn, nil
+	}
+	return withParams(dsn, [][2]string{
+		{"sslmode", opts.Mode},
+		{"sslrootcert", opts.RootCert},
+		{"sslcert", opts.Cert},
+		{"sslkey", opts.Key},
+	})
+}
+
+// Add each of the parameters in `params` that is not empty and not already
+// set to the connection string `dsn`
+// Both styles the postgres driver accepts are supported: a URL, such as
+// "postgresql://root@localhost:26257/bank?sslmode=disable", and key-value
+// pairs, such as "host=localhost port=26257 user=root dbname=bank"
+func withParams(dsn string, params [][2]string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			// The parse error is not wrapped, because it quotes the
+			// connection string, password included
+			return "", errors.New("cannot parse the connection string as a URL: check that special characters in the password are percent-encoded")
+		}
+		query := u.Query()
+		for _, param := range params {
+			if param[1] != "" && !query.Has(param[0]) {
+				query.Set(param[0], param[1])
+			}
+		}
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	keys, err := keyValueKeys(dsn)
+	if err != nil {
+		return "", err
+	}
+	for _, param := range params {
+		if param[1] != "" && !keys[param[0]] {
+			value := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(param[1])
+			dsn = strings.TrimSpace(dsn + " " + param[0] + "='" + value + "'")
+		}
+	}
+	return dsn, nil
+}
+
+// Return the set of keys in a key-value connection string, such as
+// "host=localhost user='my user'"
+func keyValueKeys(dsn string) (map[string]bool, error) {
+	pairs, err := keyValuePairs(dsn)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for _, pair := range pairs {
+		keys[pair[0]] = true
+	}
+	return keys, nil
+}
+
+// Split a key-value connection string into its keys and values, in order
+// Values may be quoted with single quotes, inside which a backslash escapes
+// the next character. Each value is returned as written, quotes included
+func keyValuePairs(dsn string) ([][2]string, error) {
+	var pairs [][2]string
+	rest := strings.TrimSpace(dsn)
+	for rest != "" {
+		key, value, ok := strings.Cut(rest, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, errors.New("cannot parse the connection string: expected a postgresql:// URL or key=value pairs")
+		}
+		value = strings.TrimLeft(value, " \t")
+		if strings.HasPrefix(value, "'") {
+			end := 1
+			for ; end < len(value) && value[end] != '\''; end++ {
+				if value[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(value) {
+				return nil, fmt.Errorf("cannot parse the connection string: unterminated quoted value for %q", key)
+			}
+			pairs = append(pairs, [2]string{key, value[:end+1]})
+			rest = value[end+1:]
+		} else if i := strings.IndexAny(value, " \t"); i >= 0 {
+			pairs = append(pairs, [2]string{key, value[:i]})
+			rest = value[i:]
+		} else {
+			pairs = append(pairs, [2]string{key, value})
+			rest = ""
+		}
+		rest = strings.TrimSpace(rest)
+	}
+	return pairs, nil
+}
+
+// Return the connection string `dsn` with its password replaced by "****",
+// so that it can be logged
+// The password may be in the user information of a URL, or in a "password"
+// parameter of either style. A connection string that cannot be parsed is
+// not shown at all, since there is no telling where its password is
+func redactDSN(dsn string) string {
+	const mask = "****"
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "(unparsable connection string)"
+		}
+		// The mask is spliced in by hand, because `url.URL` would
+		// percent-encode it
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			if key, _, _ := strings.Cut(param, "="); key == "password" {
+				params[i] = "password=" + mask
+			}
+		}
+		u.RawQuery = strings.Join(params, "&")
+		_, hasPassword := u.User.Password()
+		if !hasPassword {
+			return u.String()
+		}
+		user := u.User
+		u.User = nil
+		return u.Scheme + "://" + url.User(user.Username()).String() + ":" + mask + "@" + strings.TrimPrefix(u.String(), u.Scheme+"://")
+	}
+
+	pairs, err := keyValuePairs(dsn)
+	if err != nil {
+		return "(unparsable connection string)"
+	}
+	parts := make([]string, len(pairs))
+	for i, pair := range pairs {
+		if pair[0] == "password" {
+			pair[1] = mask
+		}
+		parts[i] = pair[0] + "=" + pair[1]
+	}
+	return strings.Join(parts, " ")
+}
+
+// How `retryWithBackoff` retries: up to `MaxAttempts` attempts in all, with
+// the cap on the delay between them growing up to `MaxBackoff`
+type retryPolicy struct {
+	MaxAttempts int
+	MaxBackoff  time.Duration
+}
+
+// Call `fn` until it succeeds, giving up after `policy.MaxAttempts` failed
+// attempts, or at once on an error that `retryable` rejects
+// The cap on the delay between attempts starts at half a second and doubles
+// after every failure, up to `policy.MaxBackoff`. Each delay is drawn at
+// random between 0 and the cap ("full jitter"), so that many instances
+// started together, e.g. as Kubernetes pods, do not all retry at the same
+// moment. `what` describes the operation in the log messages
+func retryWithBackoff(ctx context.Context, what string, policy retryPolicy, retryable func(error) bool, fn func() error) error {
+	backoff := min(500*time.Millisecond, policy.MaxBackoff)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !retryable(err) {
+			return fmt.Errorf("%s failed: %w", what, err)
+		}
+		if attempt >= policy.MaxAttempts {
+			return fmt.Errorf("%s failed after %d attempts: %w", what, attempt, err)
+		}
+		sleep := time.Duration(rand.Int63n(int64(backoff) + 1))
+		slog.WarnContext(ctx, what+" failed, retrying", "attempt", attempt, "max_attempts", policy.MaxAttempts, "sleep", sleep, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleep):
+		}
+		backoff = min(2*backoff, policy.MaxBackoff)
+	}
+}
+
+// SQLSTATE codes of errors that go away on their own: transaction conflicts
+// (40001, 40003), a node that is shutting down or still starting (57P01,
+// 57P02, 57P03), and a concurrent schema change on the same table (55000,
+// 55P03)
+var transientCodes = []string{"40001", "40003", "57P01", "57P02", "57P03", "55000", "55P03"}
+
+// Report whether `err` is worth retrying: a connection that failed or was
+// cut, or an error with one of `transientCodes`, or in class 08 (connection
+// exception). Errors such as a missing privilege (42501), bad SQL, or a
+// constraint violation fail the same way every time
+func isTransient(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return slices.Contains(transientCodes, pgErr.Code) || strings.HasPrefix(pgErr.Code, "08")
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr) || pgconn.SafeToRetry(err)
+}
+
+// A `retryWithBackoff` predicate that retries every error
+func retryAll(error) bool {
+	return true
+}
+
+// Open a connection to the database and make sure it is live
+// The database may still be starting up (e.g., in docker-compose), so the
+// connection is retried as `policy` says, whatever the error, since a node
+// that is starting can fail in more ways than `isTransient` knows of
+func connect(ctx context.Context, dsn string, policy retryPolicy, config *gorm.Config) (*gorm.DB, error) {
+	var db *gorm.DB
+	err := retryWithBackoff(ctx, "Connecting to the database", policy, retryAll, func() error {
+		var err error
+		db, err = gorm.Open(postgres.Open(dsn), config)
+		if err != nil {
+			return err
+		}
+		sqlDB, err := db.DB()
+		if err != nil {
+			return err
+		}
+		if err := sqlDB.PingContext(ctx); err != nil {
+			sqlDB.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Check that the database answers, and return the version string it reports
+func ping(ctx context.Context, db *gorm.DB) (string, error) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return "", err
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return "", err
+	}
+	var version string
+	if err := db.WithContext(ctx).Raw("SELECT version()").Scan(&version).Error; err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// A schema name, unqualified (e.g., "bank")
+var tablePrefixPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Turn the `-schema` flag into the prefix GORM puts in front of table names
+// An empty value means no prefix (tables are created in the current schema of
+// the database from the connection string); otherwise the value gets a
+// trailing dot, so that "bank" maps the `Account` model to "bank.accounts"
+// The value must name a user-defined schema in that database, created with
+// CREATE SCHEMA. A database name would not do: GORM reads the part before
+// the dot as the schema when it looks a table up in information_schema, so
+// it would never find tables that live in the database's "public" schema
+func tablePrefix(name string) (string, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return "", nil
+	}
+	if !tablePrefixPattern.MatchString(name) {
+		return "", fmt.Errorf("invalid -schema value %q: must be a single schema name such as \"bank\"", name)
+	}
+	return name + ".", nil
+}
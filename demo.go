@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/cockroachlabs/example-app-go-gorm/store"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Run the example from start to finish: insert accounts, transfer funds
+// between them, print the balances, and delete the accounts again
+// Any error that should make the program exit with a non-zero status is
+// returned to `main`
+func runDemo(ctx context.Context, args []string) (err error) {
+	fs := flag.NewFlagSet("demo", flag.ExitOnError)
+	conn := addConnFlags(fs)
+	// The number of initial rows to insert
+	numAccts := fs.Int("rows", 5, "number of accounts to insert (must be positive)")
+	// The amount to be transferred between two accounts
+	transferAmt := fs.Int("amount", 100, "amount in whole dollars to transfer between two accounts (must be positive)")
+	// Whether to remove the accounts instead of soft-deleting them
+	hardDelete := fs.Bool("hard-delete", false, "permanently remove the created accounts instead of soft-deleting them")
+	// Whether to empty the tables instead of deleting only the new accounts
+	truncate := fs.Bool("truncate", false, "empty the accounts and customers tables at the end, including rows from earlier runs, instead of deleting only the created accounts (requires -yes)")
+	confirmTruncate := fs.Bool("yes", false, "confirm -truncate, which cannot be undone")
+	// The page of accounts to print
+	limit := fs.Int("limit", 0, "maximum number of accounts to print (0 means all)")
+	offset := fs.Int("offset", 0, "number of accounts, ordered by ID, to skip before printing")
+	// The seed for the random balances and transfer destination
+	seed := fs.Int64("seed", 0, "seed for the random number generator, to reproduce a run (0 means a time-based seed)")
+	// The number of rows to insert per statement
+	batchSize := fs.Int("batch-size", 1000, "number of accounts to insert per INSERT statement, or to read per query when printing (must be positive)")
+	// The concurrent transfer mode settings
+	concurrency := fs.Int("concurrency", 0, "number of goroutines running random transfers at once, instead of a single transfer (0 disables)")
+	// The sequential random transfer mode settings
+	numTransfers := fs.Int("transfers", 0, "number of random transfers to run one after another across the new accounts, instead of a single transfer (0 disables)")
+	maxTransferAmt := fs.Int("max-transfer-amount", 0, "upper bound in whole dollars of the amount of each random transfer (0 means -amount)")
+	transferAccounts := fs.Int("accounts", 0, "number of the new accounts, the first inserted, that -transfers draws from, to concentrate them and their rejections on fewer balances (0 means all, otherwise at least 2 and at most -rows)")
+	singleTx := fs.Bool("single-tx", false, "run all of the -transfers in one transaction, which commits or rolls back as a whole, instead of one transaction each")
+	// Whether to run two conflicting transfers to show transaction retries
+	simulateContention := fs.Bool("simulate-contention", false, "run two overlapping transfers of -amount in opposite directions between the same accounts, which forces one of them to be retried, and report the retries")
+	poolStatsEvery := fs.Duration("pool-stats-every", 5*time.Second, "log the connection pool statistics, including the time spent waiting for connections, this often during -concurrency (0 disables)")
+	duration := fs.Duration("duration", 10*time.Second, "how long to run concurrent transfers for (must be shorter than -timeout)")
+	// How often to repeat the transfer step, instead of running it once
+	interval := fs.Duration("interval", 0, "repeat the transfer step this often, printing the balances after each run, until interrupted (0 runs it once)")
+	// Whether to print the statements that change data instead of running them
+	dryRun := fs.Bool("dry-run", false, "print the SQL that would insert, transfer, and delete accounts without running it")
+	// Whether to only print the existing accounts
+	listOnly := fs.Bool("list-only", false, "only print the balances of the existing accounts, without migrating, inserting, transferring, or deleting anything")
+	// Whether to skip deleting the accounts at the end
+	keepData := fs.Bool("keep-data", false, "keep the created accounts instead of deleting them at the end")
+	// The range of the random initial balances
+	minBalance := fs.Int("min-balance", 100, "lowest initial balance in whole dollars (must be at least -amount)")
+	maxBalance := fs.Int("max-balance", 10100, "upper bound, exclusive, of the initial balances in whole dollars (must be greater than -min-balance)")
+	// How far below zero each new account may go
+	overdraftLimit := fs.Int("overdraft-limit", 0, "amount in whole dollars by which each new account may be overdrawn (must not be negative)")
+	// How often to log the progress of the insert
+	progressEvery := fs.Int("progress-every", 1000, "log the number of accounts inserted each time it passes a multiple of this, checked after every -batch-size rows (0 disables)")
+	names := fs.String("names", "alice,bob,carol,dave,erin", "comma-separated names of the new accounts, in order (accounts beyond the list get generated labels)")
+	// The format of the balance and transfer printouts
+	output := fs.String("output", "text", "format of the balance and transfer printouts on stdout: text or json")
+	// How far in the past to read the printed balances
+	asOf := fs.Duration("as-of", 0, "print balances as they were this long ago, e.g. 10s, using AS OF SYSTEM TIME (0 reads current balances)")
+	// The existing accounts to transfer between, instead of new ones
+	from := fs.String("from", "", "UUID of an existing account to transfer from, instead of inserting accounts (requires -to)")
+	to := fs.String("to", "", "UUID of an existing account to transfer to (requires -from)")
+	isolation := addIsolationFlag(fs)
+	balanceCap := addBalanceCapFlag(fs)
+	// Whether to log how long each phase took
+	timing := fs.Bool("timing", false, "log how long each phase of the run took, once it ends")
+	fs.Parse(args)
+	defer func() { err = forOutput(err, *output) }()
+
+	if err := conn.init(); err != nil {
+		return err
+	}
+	ctx = withRunID(ctx, conn.runID)
+	maxBalanceCap, err := parseBalanceCap(*balanceCap)
+	if err != nil {
+		return err
+	}
+	if *numAccts <= 0 {
+		return fmt.Errorf("invalid -rows value %d: the number of accounts must be positive", *numAccts)
+	}
+	if *batchSize <= 0 {
+		return fmt.Errorf("invalid -batch-size value %d: the batch size must be positive", *batchSize)
+	}
+	if *transferAmt <= 0 {
+		return fmt.Errorf("invalid -amount value %d: the transfer amount must be positive", *transferAmt)
+	}
+	for _, f := range []struct {
+		name    string
+		dollars int
+	}{{"amount", *transferAmt}, {"min-balance", *minBalance}, {"max-balance", *maxBalance}, {"overdraft-limit", *overdraftLimit}, {"max-transfer-amount", *maxTransferAmt}} {
+		if err := checkDollars(f.name, f.dollars); err != nil {
+			return err
+		}
+	}
+	if *maxBalance <= *minBalance {
+		return fmt.Errorf("invalid -max-balance value %d: must be greater than -min-balance (%d)", *maxBalance, *minBalance)
+	}
+	// Every new account, and so the source of the transfer, must be able to
+	// cover the transfer, so that the demo does not fail on a random balance
+	if *minBalance < *transferAmt {
+		return fmt.Errorf("invalid -min-balance value %d: must be at least the transfer amount (%d)", *minBalance, *transferAmt)
+	}
+	if *overdraftLimit < 0 {
+		return fmt.Errorf("invalid -overdraft-limit value %d: the limit must not be negative", *overdraftLimit)
+	}
+	if *progressEvery < 0 {
+		return fmt.Errorf("invalid -progress-every value %d: the number of rows must not be negative", *progressEvery)
+	}
+	if err := validateOutput(*output); err != nil {
+		return err
+	}
+	if *concurrency < 0 {
+		return fmt.Errorf("invalid -concurrency value %d: the number of goroutines must not be negative", *concurrency)
+	}
+	if *concurrency > 0 && (*duration <= 0 || *duration >= *conn.timeout) {
+		return fmt.Errorf("invalid -duration value %s: must be positive and shorter than -timeout (%s)", *duration, *conn.timeout)
+	}
+	if *poolStatsEvery < 0 {
+		return fmt.Errorf("invalid -pool-stats-every value %s: the interval must not be negative", *poolStatsEvery)
+	}
+	if *numTransfers < 0 {
+		return fmt.Errorf("invalid -transfers value %d: the number of transfers must not be negative", *numTransfers)
+	}
+	if *numTransfers > 0 && *concurrency > 0 {
+		return errors.New("-transfers cannot be combined with -concurrency")
+	}
+	if *simulateContention && (*concurrency > 0 || *numTransfers > 0) {
+		return errors.New("-simulate-contention cannot be combined with -concurrency or -transfers")
+	}
+	if *simulateContention && *dryRun {
+		return errors.New("-simulate-contention cannot be combined with -dry-run")
+	}
+	if *transferAccounts != 0 && (*transferAccounts < 2 || *transferAccounts > *numAccts) {
+		return fmt.Errorf("invalid -accounts value %d: must be at least 2 and at most -rows (%d)", *transferAccounts, *numAccts)
+	}
+	if *transferAccounts != 0 && *numTransfers == 0 {
+		return errors.New("-accounts requires -transfers")
+	}
+	if *singleTx && *numTransfers == 0 {
+		return errors.New("-single-tx requires -transfers")
+	}
+	if *maxTransferAmt < 0 {
+		return fmt.Errorf("invalid -max-transfer-amount value %d: the amount must not be negative", *maxTransferAmt)
+	}
+	if *maxTransferAmt == 0 {
+		*maxTransferAmt = *transferAmt
+	}
+	if *interval < 0 {
+		return fmt.Errorf("invalid -interval value %s: the interval must not be negative", *interval)
+	}
+	if *interval > 0 && *concurrency > 0 {
+		return errors.New("-interval cannot be combined with -concurrency")
+	}
+	if *dryRun && *concurrency > 0 {
+		return errors.New("-dry-run cannot be combined with -concurrency")
+	}
+	if *truncate && !*confirmTruncate {
+		return errors.New("-truncate deletes every account, including those not created by this run; add -yes to confirm")
+	}
+	if *truncate && *keepData {
+		return errors.New("-truncate cannot be combined with -keep-data")
+	}
+	if *limit < 0 {
+		return fmt.Errorf("invalid -limit value %d: the limit must not be negative", *limit)
+	}
+	if *offset < 0 {
+		return fmt.Errorf("invalid -offset value %d: the offset must not be negative", *offset)
+	}
+	if *asOf < 0 {
+		return fmt.Errorf("invalid -as-of value %s: the duration must not be negative", *asOf)
+	}
+	listOpts := store.ListOptions{Limit: *limit, Offset: *offset, AsOf: *asOf}
+	txOpts, err := txOptions(*isolation)
+	if err != nil {
+		return err
+	}
+	// With -from and -to, the transfer runs between the given accounts, and
+	// no accounts are inserted or deleted
+	explicit := *from != "" || *to != ""
+	var fromID, toID uuid.UUID
+	if explicit {
+		var err error
+		if fromID, err = parseAccountID("from", *from); err != nil {
+			return err
+		}
+		if toID, err = parseAccountID("to", *to); err != nil {
+			return err
+		}
+		if *concurrency > 0 || *numTransfers > 0 {
+			return errors.New("-from and -to cannot be combined with -concurrency or -transfers")
+		}
+		if *truncate {
+			return errors.New("-from and -to cannot be combined with -truncate")
+		}
+	}
+
+	rng := newRand(*seed)
+
+	// The time spent in each phase, logged when the run ends
+	var times phaseTimes
+	if *timing {
+		defer times.log()
+	}
+
+	phaseStart := time.Now()
+	db, closeDB, err := openDB(conn, ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	times.record("connect", phaseStart)
+
+	// Every query below runs with this context, so that a hung connection
+	// fails once `timeout` is reached instead of blocking forever
+	// With -interval, the repeated transfers get fresh timeouts from
+	// `rootCtx` instead
+	rootCtx := ctx
+	ctx, cancel := context.WithTimeout(ctx, *conn.timeout)
+	defer cancel()
+
+	// A read-only run, safe against a populated database. It does not
+	// migrate either, so the tables must already exist
+	if *listOnly {
+		return store.PrintBalances(ctx, db, listOpts, *output, *batchSize)
+	}
+
+	phaseStart = time.Now()
+	if err := migrate(ctx, db, conn.retry(), *conn.uuidFunction, *conn.noMigrate); err != nil {
+		return err
+	}
+	times.record("migrate", phaseStart)
+
+	// In a dry run, the statements that would change data are built and
+	// printed by GORM's logger, but never sent to the database. Reads still
+	// use `db`, so the balances of existing accounts are printed as usual
+	writeDB := db
+	if *dryRun {
+		writeDB = db.Session(&gorm.Session{DryRun: true, Logger: conn.gormLogger.LogMode(logger.Info)})
+	}
+
+	// The number of transaction attempts in each phase, summarized when
+	// the run ends
+	var insertAttempts, transferAttempts, deleteAttempts int
+	defer func() {
+		slog.InfoContext(ctx, "Transaction attempts", "insert", insertAttempts, "transfer", transferAttempts, "delete", deleteAttempts)
+	}()
+
+	// Progress messages are left out of JSON runs, whose output is meant
+	// for other programs
+	progress := *progressEvery
+	if *output == "json" {
+		progress = 0
+	}
+
+	// The accounts are inserted and deleted through `accounts`, whose
+	// methods run in transactions of their own
+	accounts := store.NewGormAccountStore(writeDB)
+	accounts.BatchSize = *batchSize
+	accounts.ProgressEvery = progress
+
+	// Insert `numAccts` rows into the "accounts" table.
+	// To handle potential transaction retry errors, `Create` wraps the
+	// inserts in `store.ExecuteTx`, which counts the attempts of
+	// `crdbgorm.ExecuteTx`, a helper function for GORM which implements
+	// a retry loop
+	var acctIDs []uuid.UUID
+	if !explicit {
+		phaseStart = time.Now()
+		newAccounts := store.NewAccounts(rng, *numAccts, *minBalance, *maxBalance, *overdraftLimit, accountNames(*names))
+		insertAttempts, err = accounts.Create(ctx, newAccounts)
+		times.record("insert", phaseStart)
+		slog.InfoContext(ctx, "Insert phase finished", "attempts", insertAttempts)
+		if err != nil {
+			// For information and reference documentation, see:
+			//   https://www.cockroachlabs.com/docs/stable/error-handling-and-troubleshooting.html
+			return err
+		}
+		for _, account := range newAccounts {
+			acctIDs = append(acctIDs, account.ID)
+		}
+		// Select two distinct account IDs. With a single account there is
+		// nothing to transfer between, and the transfers are skipped below
+		if len(acctIDs) >= 2 {
+			if fromID, toID, err = selectAccounts(rng, acctIDs); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Print balances before transfer.
+	phaseStart = time.Now()
+	if err := store.PrintBalances(ctx, db, listOpts, *output, *batchSize); err != nil {
+		return err
+	}
+	times.record("print", phaseStart)
+
+	// A transfer only moves money between accounts, so the total balance
+	// must be the same before and after it
+	totalBefore, err := store.TotalBalance(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	// Transfer funds between accounts.  To handle potential
+	// transaction retry errors, we wrap the call to `store.TransferFunds`
+	// in `store.ExecuteTransfer`, which runs it with `store.ExecuteTx`
+	// A failed transfer is reported at the end, after the accounts
+	// have been cleaned up
+	// With -interval, the transfer step is repeated until interrupted
+	transfer := func(ctx context.Context) (int, error) {
+		if *concurrency > 0 {
+			return concurrentTransfers(ctx, writeDB, txOpts, rng, acctIDs, *concurrency, *duration, model.Dollars(*transferAmt), maxBalanceCap, *poolStatsEvery)
+		}
+		if *simulateContention {
+			return contendedTransfers(ctx, writeDB, txOpts, fromID, toID, model.Dollars(*transferAmt), maxBalanceCap)
+		}
+		// With -accounts, the random transfers only draw from the first
+		// accounts inserted
+		transferIDs := acctIDs
+		if *transferAccounts > 0 {
+			transferIDs = acctIDs[:*transferAccounts]
+		}
+		if *numTransfers > 0 && *singleTx {
+			return batchTransfers(ctx, writeDB, txOpts, rng, transferIDs, *numTransfers, model.Dollars(*maxTransferAmt), maxBalanceCap)
+		}
+		if *numTransfers > 0 {
+			return randomTransfers(ctx, writeDB, txOpts, rng, transferIDs, *numTransfers, model.Dollars(*maxTransferAmt), maxBalanceCap)
+		}
+		// The key is created once, outside of the retry loop, so every
+		// attempt refers to the same request
+		key := uuid.NewString()
+		return store.ExecuteTransfer(ctx, writeDB, txOpts,
+			func(tx *gorm.DB) error {
+				return store.TransferFunds(ctx, tx, key, fromID, toID, model.Dollars(*transferAmt), maxBalanceCap)
+			},
+		)
+	}
+	var transferErr error
+	phaseStart = time.Now()
+	transferStart := phaseStart
+	if !explicit && len(acctIDs) < 2 {
+		slog.InfoContext(ctx, "Skipping the transfers, which need at least two accounts", "accounts", len(acctIDs))
+	} else if *interval > 0 {
+		transferAttempts, transferErr = repeatTransfers(rootCtx, *interval, *conn.timeout, *output,
+			func(ctx context.Context) (int, error) {
+				attempts, err := transfer(ctx)
+				return attempts, errors.Join(err, store.PrintBalances(ctx, db, listOpts, *output, *batchSize))
+			},
+		)
+		// The loop ends on Ctrl+C, which cancels `ctx` too, so the rest
+		// of the run gets a context of its own to check and clean up in
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(rootCtx), *conn.timeout)
+		defer cancel()
+	} else {
+		transferAttempts, transferErr = transfer(ctx)
+	}
+	times.record("transfer", phaseStart)
+	slog.InfoContext(ctx, "Transfer phase finished", "attempts", transferAttempts)
+
+	// Print balances after transfer to ensure that it worked.
+	// A printout that fails is reported with the transfer error, after the
+	// accounts have been cleaned up
+	phaseStart = time.Now()
+	transferErr = errors.Join(transferErr,
+		store.PrintBalances(ctx, db, listOpts, *output, *batchSize),
+		store.PrintTransfers(ctx, db, transferStart, *output),
+		store.PrintCustomerBalances(ctx, db, *output),
+	)
+	times.record("print", phaseStart)
+
+	totalAfter, err := store.TotalBalance(ctx, db)
+	if err != nil {
+		return err
+	}
+	if totalAfter != totalBefore {
+		slog.ErrorContext(ctx, "Total balance changed during transfer", "before", totalBefore.String(), "after", totalAfter.String())
+	}
+
+	// Leave the accounts in place to inspect them after the program exits.
+	// Accounts given with -from and -to were not created by this run, so
+	// they are never deleted
+	if explicit {
+		return transferErr
+	}
+	if *keepData {
+		slog.InfoContext(ctx, "Keeping accounts", "ids", acctIDs)
+		return transferErr
+	}
+
+	// Empty the tables, so that the next run starts from a clean slate.
+	// TRUNCATE is a single statement, so it is not wrapped in a transaction
+	phaseStart = time.Now()
+	if *truncate {
+		if err := store.TruncateAccounts(ctx, writeDB); err != nil {
+			return err
+		}
+		times.record("delete", phaseStart)
+		return transferErr
+	}
+
+	// Delete all accounts created by the earlier call to `Create`
+	// To handle potential transaction retry errors, `DeleteByIDs` wraps
+	// the deletes in `store.ExecuteTx`
+	deleteAttempts, err = accounts.DeleteByIDs(ctx, acctIDs, *hardDelete)
+	if err != nil {
+		// For information and reference documentation, see:
+		//   https://www.cockroachlabs.com/docs/stable/error-handling-and-troubleshooting.html
+		return err
+	}
+	times.record("delete", phaseStart)
+	return transferErr
+}
+
+// The time spent in each phase of a demo run, in the order the phases first
+// ran. A phase that runs more than once, like printing, adds up
+type phaseTimes struct {
+	names   []string
+	elapsed map[string]time.Duration
+}
+
+// Add the time since `start` to the phase `name`
+func (p *phaseTimes) record(name string, start time.Time) {
+	if p.elapsed == nil {
+		p.elapsed = map[string]time.Duration{}
+	}
+	if _, ok := p.elapsed[name]; !ok {
+		p.names = append(p.names, name)
+	}
+	p.elapsed[name] += time.Since(start)
+}
+
+// Log the time spent in every phase, and in all of them together
+func (p *phaseTimes) log() {
+	var total time.Duration
+	attrs := make([]interface{}, 0, 2*len(p.names)+2)
+	for _, name := range p.names {
+		attrs = append(attrs, name, p.elapsed[name].Round(time.Millisecond))
+		total += p.elapsed[name]
+	}
+	attrs = append(attrs, "total", total.Round(time.Millisecond))
+	slog.Info("Phase timings", attrs...)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Run the demo against a mock database, in place of the one the flags name
+// The tables are checked instead of migrated, with -no-migrate, so the
+// expectations start with one `HasTable` query per model
+func runMockDemo(t *testing.T, args ...string) (sqlmock.Sqlmock, func() error) {
+	t.Helper()
+	sqlDB, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{Logger: logger.Discard, SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, defaultLogger := openDB, slog.Default()
+	openDB = func(*connFlags, context.Context) (*gorm.DB, func(), error) { return db, func() {}, nil }
+	t.Cleanup(func() {
+		openDB = open
+		slog.SetDefault(defaultLogger)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	for range models {
+		mock.ExpectQuery(`SELECT count(*) FROM information_schema.tables WHERE table_schema = CURRENT_SCHEMA() AND table_name = $1 AND table_type = $2`).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	}
+	return mock, func() error {
+		return runDemo(context.Background(), append([]string{"-no-migrate", "-log-level", "error"}, args...))
+	}
+}
+
+func TestDemoInsertFails(t *testing.T) {
+	mock, run := runMockDemo(t, "-rows", "2")
+	insertErr := errors.New("insert failed")
+	mock.ExpectBegin()
+	mock.ExpectExec(`SAVEPOINT cockroach_restart`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`INSERT INTO "customers" ("name","deleted_at","id") VALUES ($1,$2,$3),($4,$5,$6) RETURNING "id"`).
+		WillReturnError(insertErr)
+	mock.ExpectRollback()
+
+	if err := run(); !errors.Is(err, insertErr) {
+		t.Errorf("runDemo() = %v, want %v", err, insertErr)
+	}
+}
+
+func TestDemoAccountsFlag(t *testing.T) {
+	defaultLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+	for _, accounts := range []string{"-1", "1", "6"} {
+		t.Run(accounts, func(t *testing.T) {
+			err := runDemo(context.Background(), []string{"-log-level", "error", "-rows", "5", "-transfers", "10", "-accounts", accounts})
+			if err == nil || !strings.Contains(err.Error(), "invalid -accounts value") {
+				t.Errorf("runDemo() with -accounts %s = %v, want an invalid -accounts value error", accounts, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/cockroachlabs/example-app-go-gorm/store"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// The flags shared by every command that connects to the database: the
+// connection string and TLS settings, the connection pool, the time limit,
+// and the loggers
+type connFlags struct {
+	// The flag set the flags are registered on, so that `init` can fill in
+	// the values from the `-config` file
+	fs         *flag.FlagSet
+	configPath *string
+	dsn        *string
+	dsnFile    *string
+	// The parts of a connection string built with `buildDSN`
+	host     *string
+	port     *int
+	user     *string
+	password *string
+	dbName   *string
+	// The user-defined schema holding the tables
+	schemaName  *string
+	sslMode     *string
+	sslRootCert *string
+	sslCert     *string
+	sslKey      *string
+	// The time limit for all database operations
+	timeout         *time.Duration
+	maxOpenConns    *int
+	maxIdleConns    *int
+	connMaxLifetime *time.Duration
+	connectAttempts *int
+	retryMaxBackoff *time.Duration
+	prepareStmt     *bool
+	uuidFunction    *string
+	noMigrate       *bool
+	appName         *string
+	logFormat       *string
+	logLevel        *string
+	gormLogLevel    *string
+	runIDFlag       *string
+
+	// Set by `init` from the flags above
+	runID      string
+	gormLogger logger.Interface
+	prefix     string
+	tls        tlsOptions
+}
+
+// Register the shared connection flags on `fs`
+func addConnFlags(fs *flag.FlagSet) *connFlags {
+	c := &connFlags{fs: fs}
+	c.configPath = fs.String("config", "", "path to a YAML file with settings such as dsn, rows, amount, and log_level (flags given on the command line take precedence)")
+	c.dsn = fs.String("dsn", "",
+		"connection string, either a URL such as \"postgresql://<user>:<password>@<host>:26257/<database>?sslmode=verify-full\" "+
+			"or key-value pairs such as \"host=<host> port=26257 user=<user> dbname=<database>\" "+
+			"(environment variable references such as $HOME are expanded; defaults to -dsn-file, then $DATABASE_URL, then -host, then a prompt on stdin)")
+	c.dsnFile = fs.String("dsn-file", "", "path to a file containing the connection string, e.g. a mounted secret")
+	// The parts of a connection string, for those who would rather not
+	// write one. They are only used without -dsn, -dsn-file, and
+	// $DATABASE_URL, and -sslmode applies to them like to any other
+	c.host = fs.String("host", "", "host of the cluster, to connect without a connection string, e.g. localhost")
+	c.port = fs.Int("port", 26257, "port of the cluster, with -host")
+	c.user = fs.String("user", "root", "user to connect as, with -host")
+	c.password = fs.String("password", "", "password of -user, with -host (visible to other local users in the process list; prefer -dsn-file for secrets)")
+	c.dbName = fs.String("dbname", "defaultdb", "database to connect to, with -host")
+	c.schemaName = fs.String("schema", "", "user-defined schema for the tables, created beforehand with CREATE SCHEMA in the database of the connection string, e.g. \"bank\" for bank.accounts (defaults to the current schema)")
+	// The TLS settings, for clusters that need them, such as CockroachDB Cloud
+	c.sslMode = fs.String("sslmode", "", "TLS mode: disable, allow, prefer, require, verify-ca, or verify-full (defaults to the connection string's, or prefer)")
+	c.sslRootCert = fs.String("sslrootcert", "", "path to the CA certificate used to verify the cluster (defaults to the connection string's)")
+	c.sslCert = fs.String("sslcert", "", "path to the client certificate, for certificate authentication (requires -sslkey)")
+	c.sslKey = fs.String("sslkey", "", "path to the private key of the client certificate (requires -sslcert)")
+	c.timeout = fs.Duration("timeout", 30*time.Second, "time limit for all database operations, e.g. 30s or 2m (must be positive)")
+	// The connection pool settings
+	c.maxOpenConns = fs.Int("max-open-conns", 20, "maximum number of open connections to the database (0 means unlimited)")
+	c.maxIdleConns = fs.Int("max-idle-conns", 20, "maximum number of idle connections kept in the pool (0 means none)")
+	c.connMaxLifetime = fs.Duration("conn-max-lifetime", 5*time.Minute, "maximum amount of time a connection may be reused (0 means forever)")
+	// The number of times to try connecting, or migrating, before giving up
+	c.connectAttempts = fs.Int("connect-attempts", 10, "maximum number of attempts to connect to the database, and to migrate the schema (must be positive)")
+	c.retryMaxBackoff = fs.Duration("retry-max-backoff", 10*time.Second, "longest delay between two attempts to connect or migrate; each delay is random, up to a cap that doubles from 500ms to this (must be positive)")
+	// The name the statements of the example are attributed to in the DB
+	// Console and in crdb_internal. Names starting with "$ " are hidden there
+	// as internal, so the default does not
+	c.appName = fs.String("app-name", "example-app-go-gorm", "application_name of the connections, unless the connection string sets one")
+	// Whether to cache prepared statements. Each connection prepares a
+	// statement the first time it runs it, and then only sends the
+	// arguments, which saves CockroachDB parsing and planning the same SQL
+	// over and over, e.g. in the concurrent transfer mode. In return every
+	// connection holds on to its statements, and a single query costs an
+	// extra round trip the first time. `migrate` runs before the statements
+	// that read and write accounts are prepared, so its schema changes do
+	// not leave stale statements in the cache
+	c.prepareStmt = fs.Bool("prepare-stmt", true, "cache prepared statements on each connection (set -prepare-stmt=false to send every query as text)")
+	// The function the ID columns default to. The IDs of new rows are
+	// generated in Go, so the default only matters for rows inserted by
+	// hand
+	c.uuidFunction = fs.String("uuid-function", "gen_random_uuid", "function the ID columns default to: gen_random_uuid (built in) or uuid_generate_v4 (creates the \"uuid-ossp\" extension if needed)")
+	// With least-privilege credentials, which cannot change the schema, the
+	// tables are created by hand beforehand, as the README shows
+	c.noMigrate = fs.Bool("no-migrate", false, "skip AutoMigrate and only check that the tables exist, for users without the privilege to change the schema")
+	// The structured logger settings
+	c.logFormat = fs.String("log-format", "text", "format of log messages on stderr: text or json")
+	c.logLevel = fs.String("log-level", "info", "minimum level of log messages: debug, which also logs every account created, info, warn, or error")
+	c.gormLogLevel = fs.String("gorm-log-level", "warn", "level of GORM's own log messages: silent, error, warn, or info (prints every SQL statement)")
+	c.runIDFlag = fs.String("run-id", "", "ID added to every log message of this run, to tell runs apart in shared logs (defaults to a random UUID)")
+	return c
+}
+
+// Set up the loggers and check the shared flags, once they are parsed
+// Values from the `-config` file are filled in first, for every flag of the
+// command that was not given on the command line
+// This runs before the checks of the command's own flags, so that their
+// errors are logged in the selected format
+func (c *connFlags) init() error {
+	if *c.configPath != "" {
+		config, err := loadConfig(*c.configPath)
+		if err != nil {
+			return err
+		}
+		if err := config.apply(c.fs); err != nil {
+			return err
+		}
+	}
+	c.runID = *c.runIDFlag
+	if c.runID == "" {
+		c.runID = uuid.NewString()
+	}
+	appLogger, err := newLogger(*c.logFormat, *c.logLevel, c.runID)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(appLogger)
+	if c.gormLogger, err = newGormLogger(*c.gormLogLevel); err != nil {
+		return err
+	}
+	if c.prefix, err = tablePrefix(*c.schemaName); err != nil {
+		return err
+	}
+	if *c.timeout <= 0 {
+		return fmt.Errorf("invalid -timeout value %s: the time limit must be positive", *c.timeout)
+	}
+	if !slices.Contains(uuidFunctions, *c.uuidFunction) {
+		return fmt.Errorf("invalid -uuid-function value %q: must be one of %s", *c.uuidFunction, strings.Join(uuidFunctions, ", "))
+	}
+	if *c.port <= 0 || *c.port > 65535 {
+		return fmt.Errorf("invalid -port value %d: must be from 1 to 65535", *c.port)
+	}
+	if *c.connectAttempts <= 0 {
+		return fmt.Errorf("invalid -connect-attempts value %d: the number of attempts must be positive", *c.connectAttempts)
+	}
+	if *c.retryMaxBackoff <= 0 {
+		return fmt.Errorf("invalid -retry-max-backoff value %s: the delay must be positive", *c.retryMaxBackoff)
+	}
+	c.tls = tlsOptions{Mode: *c.sslMode, RootCert: *c.sslRootCert, Cert: *c.sslCert, Key: *c.sslKey}
+	return c.tls.validate()
+}
+
+// The retry policy of connecting and migrating, from `-connect-attempts` and
+// `-retry-max-backoff`
+func (c *connFlags) retry() retryPolicy {
+	return retryPolicy{MaxAttempts: *c.connectAttempts, MaxBackoff: *c.retryMaxBackoff}
+}
+
+// The function `runDemo` opens its connection with. Tests replace it to run
+// the demo against a mock database
+var openDB = (*connFlags).open
+
+// Connect to the database with the shared flags
+// The returned function closes the connection pool, and logs any error, as
+// there is nothing else to do about it by then. Commands defer it right after
+// connecting, so it runs once their queries have finished
+func (c *connFlags) open(ctx context.Context) (*gorm.DB, func(), error) {
+	connStr, source, err := connectionString(*c.dsn, *c.dsnFile, dsnParts{
+		Host:     *c.host,
+		Port:     *c.port,
+		User:     *c.user,
+		Password: *c.password,
+		DBName:   *c.dbName,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	slog.InfoContext(ctx, "Using connection string", "source", source)
+	if connStr, err = withTLS(connStr, c.tls); err != nil {
+		return nil, nil, err
+	}
+
+	slog.InfoContext(ctx, "Connecting to the database", "dsn", redactDSN(connStr))
+
+	if connStr, err = withParams(connStr, [][2]string{{"application_name", *c.appName}}); err != nil {
+		return nil, nil, err
+	}
+
+	db, err := connect(ctx, connStr, c.retry(), &gorm.Config{
+		Logger:         c.gormLogger,
+		NamingStrategy: schema.NamingStrategy{TablePrefix: c.prefix},
+		PrepareStmt:    *c.prepareStmt,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, nil, err
+	}
+	var appName string
+	if err := db.WithContext(ctx).Raw("SELECT current_setting('application_name')").Scan(&appName).Error; err != nil {
+		sqlDB.Close()
+		return nil, nil, err
+	}
+	slog.InfoContext(ctx, "Connected to the database", "application_name", appName)
+
+	// Size the connection pool for CockroachDB. Recycling connections
+	// periodically lets them rebalance across nodes after the cluster
+	// topology changes
+	sqlDB.SetMaxOpenConns(*c.maxOpenConns)
+	sqlDB.SetMaxIdleConns(*c.maxIdleConns)
+	sqlDB.SetConnMaxLifetime(*c.connMaxLifetime)
+	closeDB := func() {
+		if err := sqlDB.Close(); err != nil {
+			slog.ErrorContext(ctx, "Closing the database connection", "error", err)
+		}
+	}
+	return db, closeDB, nil
+}
+
+// The models `migrate` creates tables for, in order
+var models = []interface{}{&model.Customer{}, &model.Account{}, &model.Transfer{}, &model.IdempotencyKey{}}
+
+// Automatically create the "customers", "accounts", "transfers", and
+// "transfer_requests" tables based on the `Customer`, `Account`,
+// `Transfer`, and `IdempotencyKey` models.
+// Tables that already exist get any columns added to the models since, such
+// as "accounts"."name"
+// Every table is then checked with `HasTable`, so that a migration that
+// failed, e.g. for lack of privileges, stops the command before any query
+// runs against a missing table
+// On a cluster that has just started, a schema change can fail for reasons
+// that go away on their own, so `AutoMigrate` is retried with backoff, as
+// `retry` says, like connecting is. Only the errors `isTransient` accepts are
+// retried, and any other fails the migration at once
+// The ID columns default to `uuidFunction`, one of `uuidFunctions`
+// With `noMigrate`, nothing is changed and the tables are only checked, which
+// needs no privileges beyond reading the catalog
+func migrate(ctx context.Context, db *gorm.DB, retry retryPolicy, uuidFunction string, noMigrate bool) error {
+	db = db.WithContext(ctx)
+	if noMigrate {
+		slog.InfoContext(ctx, "Skipping schema migration, checking the tables")
+		table, err := missingTable(db)
+		if err != nil {
+			return err
+		}
+		if table != "" {
+			return fmt.Errorf("checking the schema: table %q does not exist, and -no-migrate is set; create it by hand or run without -no-migrate", table)
+		}
+		return nil
+	}
+	slog.InfoContext(ctx, "Migrating schema", "uuid_function", uuidFunction)
+	if err := useUUIDFunction(db, uuidFunction); err != nil {
+		return fmt.Errorf("migrating the schema: %w", err)
+	}
+	if err := retryWithBackoff(ctx, "Migrating the schema", retry, isTransient, func() error {
+		return db.AutoMigrate(models...)
+	}); err != nil {
+		return err
+	}
+	// Tables created before accounts had an overdraft limit still have the
+	// old constraint, which would reject every overdraft
+	if db.Migrator().HasConstraint(&model.Account{}, "balance_non_negative") {
+		if err := db.Migrator().DropConstraint(&model.Account{}, "balance_non_negative"); err != nil {
+			return fmt.Errorf("migrating the schema: %w", err)
+		}
+	}
+	table, err := missingTable(db)
+	if err != nil {
+		return err
+	}
+	if table != "" {
+		return fmt.Errorf("migrating the schema: table %q does not exist after AutoMigrate", table)
+	}
+	return nil
+}
+
+// Return the name of the first table of `models` that does not exist, or ""
+// if they all do
+func missingTable(db *gorm.DB) (string, error) {
+	for _, m := range models {
+		if !db.Migrator().HasTable(m) {
+			stmt := &gorm.Statement{DB: db}
+			if err := stmt.Parse(m); err != nil {
+				return "", err
+			}
+			return stmt.Schema.Table, nil
+		}
+	}
+	return "", nil
+}
+
+// The functions the `-uuid-function` flag accepts. `gen_random_uuid` is built
+// into CockroachDB and PostgreSQL 13+, while `uuid_generate_v4` comes from
+// the "uuid-ossp" extension
+var uuidFunctions = []string{"gen_random_uuid", "uuid_generate_v4"}
+
+// Make `name` the default of the "id" column of every model that has one,
+// in place of the function in the model's tag
+// GORM caches the parsed models on `db`, so `AutoMigrate` sees the change.
+// For `uuid_generate_v4`, the extension is created first, if the database
+// does not have it yet
+func useUUIDFunction(db *gorm.DB, name string) error {
+	if name == "uuid_generate_v4" {
+		if err := db.Exec(`CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`).Error; err != nil {
+			return fmt.Errorf("creating the uuid-ossp extension: %w", err)
+		}
+	}
+	for _, m := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(m); err != nil {
+			return err
+		}
+		if field := stmt.Schema.LookUpField("id"); field != nil && field.HasDefaultValue {
+			field.DefaultValue = name + "()"
+		}
+	}
+	return nil
+}
+
+// Compare the live tables with the models, without changing anything, and
+// describe every difference found
+// A table or column that the model has and the database lacks is reported,
+// as is a column whose type differs from the one `AutoMigrate` would create.
+// Type names are compared up to their aliases, e.g. "int8" and "bigint", and
+// without their length or precision. Columns that only the database has are
+// reported too, since a manual schema change may have added them
+func verifySchema(ctx context.Context, db *gorm.DB) ([]string, error) {
+	db = db.WithContext(ctx)
+	migrator := db.Migrator()
+	var drift []string
+	for _, m := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(m); err != nil {
+			return nil, err
+		}
+		table := stmt.Schema.Table
+		if !migrator.HasTable(m) {
+			drift = append(drift, fmt.Sprintf("table %q is missing", table))
+			continue
+		}
+		columnTypes, err := migrator.ColumnTypes(m)
+		if err != nil {
+			return nil, fmt.Errorf("reading the columns of %q: %w", table, err)
+		}
+		live := map[string]gorm.ColumnType{}
+		for _, column := range columnTypes {
+			live[column.Name()] = column
+		}
+		for _, name := range stmt.Schema.DBNames {
+			column, ok := live[name]
+			if !ok {
+				drift = append(drift, fmt.Sprintf("column %q.%q is missing", table, name))
+				continue
+			}
+			delete(live, name)
+			want := baseTypeName(db.Dialector.DataTypeOf(stmt.Schema.FieldsByDBName[name]))
+			got := baseTypeName(column.DatabaseTypeName())
+			if got != want && !slices.Contains(migrator.GetTypeAliases(want), got) {
+				drift = append(drift, fmt.Sprintf("column %q.%q has type %s, but the model expects %s", table, name, got, want))
+			}
+		}
+		for name := range live {
+			drift = append(drift, fmt.Sprintf("column %q.%q is not in the model", table, name))
+		}
+	}
+	slices.Sort(drift)
+	return drift, nil
+}
+
+// Lower-case the SQL type name `name`, and drop its length or precision, so
+// that "DECIMAL(19,2)" becomes "decimal"
+func baseTypeName(name string) string {
+	name, _, _ = strings.Cut(strings.ToLower(name), "(")
+	return strings.TrimSpace(name)
+}
+
+// Check the `-output` flag of the commands that print accounts
+func validateOutput(output string) error {
+	if output != "text" && output != "json" {
+		return fmt.Errorf("invalid -output value %q: must be text or json", output)
+	}
+	return nil
+}
+
+// The transaction isolation levels the `-isolation` flag accepts
+var isolationLevels = map[string]sql.IsolationLevel{
+	"serializable":   sql.LevelSerializable,
+	"read-committed": sql.LevelReadCommitted,
+}
+
+// Register the `-isolation` flag of the commands that transfer funds on `fs`
+// SERIALIZABLE, CockroachDB's default, makes transactions that touch the same
+// accounts retry when they conflict, which the concurrent mode shows as extra
+// attempts. Under READ COMMITTED, CockroachDB retries conflicting statements
+// itself, and the transfers lock their rows with SELECT ... FOR UPDATE
+// anyway, so far fewer transactions are retried as a whole. READ COMMITTED
+// needs the sql.txn.read_committed_isolation.enabled cluster setting, or
+// CockroachDB silently runs the transactions as SERIALIZABLE
+func addIsolationFlag(fs *flag.FlagSet) *string {
+	return fs.String("isolation", "serializable", "isolation level of the transfer transactions: serializable or read-committed")
+}
+
+// Add the `-balance-cap` flag of the commands that change balances
+func addBalanceCapFlag(fs *flag.FlagSet) *int {
+	return fs.Int("balance-cap", int(store.DefaultMaxBalance/100), "highest balance in whole dollars that a transfer or interest may leave in an account (must be positive)")
+}
+
+// Check the `-balance-cap` flag, and return it as the highest balance to pass
+// to the transfers
+func parseBalanceCap(dollars int) (model.Money, error) {
+	if dollars <= 0 {
+		return 0, fmt.Errorf("invalid -balance-cap value %d: must be positive", dollars)
+	}
+	if err := checkDollars("balance-cap", dollars); err != nil {
+		return 0, err
+	}
+	return model.Dollars(dollars), nil
+}
+
+// The most whole dollars that `model.Dollars` converts without overflowing
+// the int64 count of cents of `model.Money`
+const maxDollars = math.MaxInt64 / 100
+
+// Check that the flag `name`, an amount in whole dollars, fits in
+// `model.Money`
+func checkDollars(name string, dollars int) error {
+	if dollars > maxDollars || dollars < -maxDollars {
+		return fmt.Errorf("invalid -%s value %d: must be at most %d whole dollars", name, dollars, maxDollars)
+	}
+	return nil
+}
+
+// Turn the `-isolation` flag into the options of the transfer transactions
+func txOptions(isolation string) (*sql.TxOptions, error) {
+	level, ok := isolationLevels[isolation]
+	if !ok {
+		return nil, fmt.Errorf("invalid -isolation value %q: must be serializable or read-committed", isolation)
+	}
+	slog.Info("Using isolation level", "isolation", isolation)
+	return &sql.TxOptions{Isolation: level}, nil
+}
+
+// Split the `-names` flag into the names of the new accounts
+func accountNames(names string) []string {
+	if names == "" {
+		return nil
+	}
+	return strings.Split(names, ",")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+)
+
+func TestParseBalanceCap(t *testing.T) {
+	tests := []struct {
+		dollars int
+		want    model.Money
+		wantErr bool
+	}{
+		{1, model.Dollars(1), false},
+		{math.MaxInt64 / 100, model.Money(math.MaxInt64 / 100 * 100), false},
+		{math.MaxInt64/100 + 1, 0, true},
+		{0, 0, true},
+		{-1, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseBalanceCap(tt.dollars)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBalanceCap(%d) error = %v, want error %v", tt.dollars, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("parseBalanceCap(%d) = %s, want %s", tt.dollars, got, tt.want)
+		}
+	}
+}
+
+func TestCheckDollars(t *testing.T) {
+	tests := []struct {
+		dollars int
+		wantErr bool
+	}{
+		{0, false},
+		{math.MaxInt64 / 100, false},
+		{-math.MaxInt64 / 100, false},
+		{math.MaxInt64/100 + 1, true},
+		{-math.MaxInt64/100 - 1, true},
+		{math.MaxInt64, true},
+	}
+	for _, tt := range tests {
+		if err := checkDollars("amount", tt.dollars); (err != nil) != tt.wantErr {
+			t.Errorf("checkDollars(%d) error = %v, want error %v", tt.dollars, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"gorm.io/gorm/logger"
+)
+
+// Build the structured logger selected with `-log-format` and `-log-level`
+// Log messages go to stderr, leaving stdout for the balance printouts
+// Every message carries a "run_id" attribute: the one stored in the context
+// it was logged with, if any, and `runID` otherwise
+func newLogger(format string, level string, runID string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid -log-level value %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("invalid -log-format value %q: must be text or json", format)
+	}
+	return slog.New(runIDHandler{Handler: handler, runID: runID}), nil
+}
+
+// The key of the run ID in a `context.Context`
+type runIDKey struct{}
+
+// Return a copy of `ctx` that carries the run ID `id`
+// The logger adds it to every message logged with the context, e.g. with
+// `slog.InfoContext`, however deep in the store the call is
+func withRunID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, id)
+}
+
+// A `slog.Handler` that adds the run ID from the context of each message,
+// falling back to `runID` for messages logged without one
+type runIDHandler struct {
+	slog.Handler
+	runID string
+}
+
+func (h runIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	id, ok := ctx.Value(runIDKey{}).(string)
+	if !ok {
+		id = h.runID
+	}
+	r.AddAttrs(slog.String("run_id", id))
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h runIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return runIDHandler{Handler: h.Handler.WithAttrs(attrs), runID: h.runID}
+}
+
+func (h runIDHandler) WithGroup(name string) slog.Handler {
+	return runIDHandler{Handler: h.Handler.WithGroup(name), runID: h.runID}
+}
+
+// Build GORM's logger from the `-gorm-log-level` flag
+// At "info", every SQL statement GORM runs is printed, which helps when
+// debugging transfers. Queries slower than 200ms are reported from "warn" up
+func newGormLogger(level string) (logger.Interface, error) {
+	levels := map[string]logger.LogLevel{
+		"silent": logger.Silent,
+		"error":  logger.Error,
+		"warn":   logger.Warn,
+		"info":   logger.Info,
+	}
+	lvl, ok := levels[level]
+	if !ok {
+		return nil, fmt.Errorf("invalid -gorm-log-level value %q: must be silent, error, warn, or info", level)
+	}
+	return logger.New(log.New(os.Stderr, "\r\n", log.LstdFlags), logger.Config{
+		SlowThreshold: 200 * time.Millisecond,
+		LogLevel:      lvl,
+	}), nil
+}
@@ -2,157 +2,140 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
-	"math/rand"
+	"io"
+	"log/slog"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
-	"github.com/cockroachdb/cockroach-go/v2/crdb/crdbgorm"
-	"github.com/google/uuid"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
+	"github.com/cockroachlabs/example-app-go-gorm/store"
 )
 
-// Account is our model, which corresponds to the "accounts" table
-type Account struct {
-	ID      uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4()"`
-	Balance int
+// The version of the example, which the release build sets with, e.g.,
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Local builds keep the defaults
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// The exit status of a command that failed because an account it was given
+// does not exist, so that scripts can tell a wrong ID from other failures,
+// which exit with status 1
+const exitNotFound = 3
+
+// A subcommand, selected by the first command-line argument
+// `run` parses the rest of the arguments with its own `flag.FlagSet`
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
 }
 
-// The `acctIDs` global variable tracks the random IDs generated by `addAccounts`
-var acctIDs []uuid.UUID
+var commands = []command{
+	{"demo", "insert accounts, transfer funds between them, print the balances, and delete them", runDemo},
+	{"insert", "insert random accounts and print their IDs", runInsert},
+	{"transfer", "transfer funds between two accounts, e.g. transfer -from <uuid> -to <uuid> -amount 50", runTransfer},
+	{"accrue", "add interest to every account with a positive balance, e.g. accrue -rate 0.05", runAccrue},
+	{"list", "print the IDs and balances of the accounts", runList},
+	{"top", "print the accounts with the highest balances, e.g. top -n 5 (-asc for the lowest)", runTop},
+	{"balance", "print the balance of one account, e.g. balance <uuid>", runBalance},
+	{"stats", "print the number of accounts and their total balance", runStats},
+	{"reconcile", "check that no account is overdrawn beyond its limit", runReconcile},
+	{"verify-schema", "check that the tables match the models, without changing them", runVerifySchema},
+	{"delete", "delete accounts and their customers, e.g. delete <uuid>...", runDelete},
+	{"export", "write the ID and balance of every account to a CSV file, e.g. export accounts.csv", runExport},
+	{"serve", "serve a REST API for accounts and transfers until interrupted", runServe},
+	{"ping", "connect, print the CockroachDB version, and exit", runPing},
+	{"version", "print the version, git commit, and build date", runVersion},
+}
 
-// Insert new rows into the "accounts" table
-// This function generates new UUIDs and random balances for each row, and
-// then it appends the ID to the `acctIDs`, which other functions use to track the IDs
-func addAccounts(db *gorm.DB, numRows int, transferAmount int) error {
-	log.Printf("Creating %d new accounts...", numRows)
-	for i := 0; i < numRows; i++ {
-		newID := uuid.New()
-		newBalance := rand.Intn(10000) + transferAmount
-		if err := db.Create(&Account{ID: newID, Balance: newBalance}).Error; err != nil {
-			return err
-		}
-		acctIDs = append(acctIDs, newID)
+// Print the list of commands to `w`
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [arguments]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-13s %s\n", cmd.name, cmd.summary)
 	}
-	log.Println("Accounts created.")
-	return nil
+	fmt.Fprintf(w, "\nRun \"%s <command> -h\" for the flags of a command.\n", os.Args[0])
+	fmt.Fprintf(w, "A command exits with status %d if an account it was given does not exist.\n", exitNotFound)
 }
 
-// Transfer funds between accounts
-// This function adds `amount` to the "balance" column of the row with the "id" column matching `toID`,
-// and removes `amount` from the "balance" column of the row with the "id" column matching `fromID`
-func transferFunds(db *gorm.DB, fromID uuid.UUID, toID uuid.UUID, amount int) error {
-	log.Printf("Transferring %d from account %s to account %s...", amount, fromID, toID)
-	var fromAccount Account
-	var toAccount Account
-
-	db.First(&fromAccount, fromID)
-	db.First(&toAccount, toID)
-
-	if fromAccount.Balance < amount {
-		return fmt.Errorf("account %s balance %d is lower than transfer amount %d", fromAccount.ID, fromAccount.Balance, amount)
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
 	}
-
-	fromAccount.Balance -= amount
-	toAccount.Balance += amount
-
-	if err := db.Save(&fromAccount).Error; err != nil {
-		return err
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		usage(os.Stdout)
+		return
 	}
-	if err := db.Save(&toAccount).Error; err != nil {
-		return err
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
 	}
-	log.Println("Funds transferred.")
-	return nil
-}
-
-// Print IDs and balances for all rows in "accounts" table
-func printBalances(db *gorm.DB) {
-	var accounts []Account
-	db.Find(&accounts)
-	fmt.Printf("Balance at '%s':\n", time.Now())
-	for _, account := range accounts {
-		fmt.Printf("%s %d\n", account.ID, account.Balance)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage(os.Stderr)
+		os.Exit(2)
 	}
-}
 
-// Delete all rows in "accounts" table inserted by `main` (i.e., tracked by `acctIDs`)
-func deleteAccounts(db *gorm.DB, accountIDs []uuid.UUID) error {
-	log.Println("Deleting accounts created...")
-	err := db.Where("id IN ?", accountIDs).Delete(Account{}).Error
-	if err != nil {
-		return err
+	// Cancel the root context on SIGINT (Ctrl+C) or SIGTERM. Queries in
+	// progress are aborted, open transactions are rolled back, and no new
+	// queries are issued
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := cmd.run(ctx, os.Args[2:]); err != nil {
+		// The error of a run with `-output json` is written as a JSON
+		// object instead, so that programs reading the output can parse it
+		var jsonErr *jsonOutputError
+		switch {
+		case errors.As(err, &jsonErr):
+			store.PrintError(jsonErr.err, "json")
+		case ctx.Err() != nil:
+			slog.Error("Interrupted", "error", err)
+		default:
+			slog.Error("Run failed", "command", cmd.name, "error", err)
+		}
+		if ctx.Err() != nil {
+			stop()
+			os.Exit(130)
+		}
+		if errors.Is(err, store.ErrAccountNotFound) {
+			os.Exit(exitNotFound)
+		}
+		os.Exit(1)
 	}
-	log.Println("Accounts deleted.")
-	return nil
 }
 
-func main() {
-
-	db, err := gorm.Open(postgres.Open(os.Getenv("DATABASE_URL")+"&application_name=$ docs_simplecrud_gorm"), &gorm.Config{})
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Automatically create the "accounts" table based on the `Account`
-	// model.
-	db.AutoMigrate(&Account{})
-
-	// The number of initial rows to insert
-	const numAccts int = 5
-
-	// The amount to be transferred between two accounts.
-	const transferAmt int = 100
-
-	// Insert `numAccts` rows into the "accounts" table.
-	// To handle potential transaction retry errors, we wrap the call
-	// to `addAccounts` in `crdbgorm.ExecuteTx`, a helper function for
-	// GORM which implements a retry loop
-	if err := crdbgorm.ExecuteTx(context.Background(), db, nil,
-		func(tx *gorm.DB) error {
-			return addAccounts(db, numAccts, transferAmt)
-		},
-	); err != nil {
-		// For information and reference documentation, see:
-		//   https://www.cockroachlabs.com/docs/stable/error-handling-and-troubleshooting.html
-		fmt.Println(err)
-	}
-
-	// Print balances before transfer.
-	printBalances(db)
-
-	// Select two account IDs
-	fromID := acctIDs[0]
-	toID := acctIDs[0:][rand.Intn(len(acctIDs))]
+// jsonOutputError is the error of a command run with `-output json`, which
+// `main` reports with `store.PrintError` as a {"error": ..., "code": ...}
+// object on stderr, rather than as a log line
+type jsonOutputError struct {
+	err error
+}
 
-	// Transfer funds between accounts.  To handle potential
-	// transaction retry errors, we wrap the call to `transferFunds`
-	// in `crdbgorm.ExecuteTx`
-	if err := crdbgorm.ExecuteTx(context.Background(), db, nil,
-		func(tx *gorm.DB) error {
-			return transferFunds(tx, fromID, toID, transferAmt)
-		},
-	); err != nil {
-		// For information and reference documentation, see:
-		//   https://www.cockroachlabs.com/docs/stable/error-handling-and-troubleshooting.html
-		fmt.Println(err)
-	}
+func (e *jsonOutputError) Error() string {
+	return e.err.Error()
+}
 
-	// Print balances after transfer to ensure that it worked.
-	printBalances(db)
+func (e *jsonOutputError) Unwrap() error {
+	return e.err
+}
 
-	// Delete all accounts created by the earlier call to `addAccounts`
-	// To handle potential transaction retry errors, we wrap the call
-	// to `deleteAccounts` in `crdbgorm.ExecuteTx`
-	if err := crdbgorm.ExecuteTx(context.Background(), db, nil,
-		func(tx *gorm.DB) error {
-			return deleteAccounts(db, acctIDs)
-		},
-	); err != nil {
-		// For information and reference documentation, see:
-		//   https://www.cockroachlabs.com/docs/stable/error-handling-and-troubleshooting.html
-		fmt.Println(err)
+// Wrap `err`, the error a command returns, so that `main` reports it as JSON
+// if `output` is "json"
+func forOutput(err error, output string) error {
+	if err == nil || output != "json" {
+		return err
 	}
+	return &jsonOutputError{err: err}
 }
@@ -0,0 +1,102 @@
+// Package model defines the GORM models of the example, which correspond to
+// the tables that `AutoMigrate` creates
+package model
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Account is our model, which corresponds to the "accounts" table
+// GORM fills in `CreatedAt` and `UpdatedAt` automatically when a row is
+// created or updated. Because of `DeletedAt`, deleting an account only marks
+// the row as deleted, and GORM leaves such rows out of all other queries.
+// `Version` is incremented by every transfer, so that a writer can detect
+// that the row changed after it was read. An account may be overdrawn by up
+// to `OverdraftLimit`, and the "balance_within_overdraft" CHECK constraint
+// makes the database itself reject balances below that
+// `Name` is a label for people reading the output. Rows that existed before
+// the column was added get an empty name
+// Like the other IDs, `ID` defaults to `gen_random_uuid()`, which CockroachDB
+// and PostgreSQL 13+ have built in. The `-uuid-function` flag can switch it to
+// `uuid_generate_v4()` from the "uuid-ossp" extension
+type Account struct {
+	ID             uuid.UUID      `gorm:"type:uuid;default:gen_random_uuid()" json:"id"`
+	Name           string         `gorm:"not null;default:''" json:"name"`
+	Balance        Money          `gorm:"type:decimal(19,2);check:balance_within_overdraft,balance + overdraft_limit >= 0" json:"balance"`
+	OverdraftLimit Money          `gorm:"type:decimal(19,2);not null;default:0;check:overdraft_limit_non_negative,overdraft_limit >= 0" json:"overdraft_limit"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`
+	Version        int            `json:"version"`
+	CustomerID     *uuid.UUID     `gorm:"type:uuid" json:"customer_id,omitempty"`
+}
+
+// BeforeSave is a GORM hook that rejects accounts overdrawn by more than their
+// limit, and negative limits
+// GORM calls it before creating or saving an `Account`, and the returned error
+// rolls back the surrounding transaction. It only sees the balance held in the
+// struct, so updates computed in SQL, like those in `store.TransferFunds`, rely
+// on the balance check done there instead
+func (a *Account) BeforeSave(tx *gorm.DB) error {
+	if a.OverdraftLimit < 0 {
+		return fmt.Errorf("account %s overdraft limit %s must not be negative", a.ID, a.OverdraftLimit)
+	}
+	if a.Balance < -a.OverdraftLimit {
+		return fmt.Errorf("account %s balance %s is below its overdraft limit %s", a.ID, a.Balance, a.OverdraftLimit)
+	}
+	return nil
+}
+
+// AfterCreate is a GORM hook that logs every new account
+// GORM calls it for each element, whether the accounts are created one at a
+// time or with `CreateInBatches`. It logs at debug level, since seeding can
+// create thousands of accounts, so the messages only appear with
+// `-log-level debug`. Nothing is logged in a dry run, where nothing was
+// created
+func (a *Account) AfterCreate(tx *gorm.DB) error {
+	if !tx.DryRun {
+		slog.DebugContext(tx.Statement.Context, "Account created", "id", a.ID, "name", a.Name, "balance", a.Balance.String())
+	}
+	return nil
+}
+
+// Customer owns any number of accounts, and corresponds to the "customers" table
+// The `Accounts` field declares the one-to-many relationship, for which
+// `AutoMigrate` creates a foreign key from "accounts"."customer_id"
+type Customer struct {
+	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid()"`
+	Name      string
+	Accounts  []Account
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// Transfer records a single movement of funds between two accounts, and
+// corresponds to the "transfers" table
+type Transfer struct {
+	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid()"`
+	FromID    uuid.UUID `gorm:"type:uuid"`
+	ToID      uuid.UUID `gorm:"type:uuid"`
+	Amount    Money     `gorm:"type:decimal(19,2)"`
+	CreatedAt time.Time
+}
+
+// IdempotencyKey marks a transfer request as processed, and corresponds to
+// the "transfer_requests" table
+// `Key` is the primary key, so recording the same request twice violates
+// its uniqueness
+type IdempotencyKey struct {
+	Key       string `gorm:"primaryKey"`
+	CreatedAt time.Time
+}
+
+// TableName maps `IdempotencyKey` to "transfer_requests", keeping any
+// table prefix from the naming strategy
+func (IdempotencyKey) TableName(namer schema.Namer) string {
+	return namer.TableName("TransferRequest")
+}
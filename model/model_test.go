@@ -0,0 +1,30 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAccountBeforeSave(t *testing.T) {
+	tests := []struct {
+		name    string
+		account Account
+		wantErr bool
+	}{
+		{"positive balance", Account{Balance: Dollars(100)}, false},
+		{"zero balance", Account{}, false},
+		{"overdrawn within the limit", Account{Balance: Dollars(-50), OverdraftLimit: Dollars(50)}, false},
+		{"overdrawn past the limit", Account{Balance: Dollars(-50) - 1, OverdraftLimit: Dollars(50)}, true},
+		{"negative without a limit", Account{Balance: -1}, true},
+		{"negative limit", Account{Balance: Dollars(100), OverdraftLimit: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.account.ID = uuid.New()
+			if err := tt.account.BeforeSave(nil); (err != nil) != tt.wantErr {
+				t.Errorf("BeforeSave() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
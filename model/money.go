@@ -0,0 +1,90 @@
+package model
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount of currency, counted in cents
+// Keeping a whole number of cents avoids the rounding errors of floating
+// point arithmetic. Money values are stored in DECIMAL(19,2) columns
+type Money int64
+
+// Dollars converts a whole number of dollars to `Money`
+func Dollars(n int) Money {
+	return Money(n) * 100
+}
+
+// Format the amount with two decimal places, e.g. "-12.50"
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// MarshalJSON encodes the amount as a JSON number with two decimal places
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON decodes a JSON number, such as 12.5, into an amount
+func (m *Money) UnmarshalJSON(data []byte) error {
+	return m.parse(string(data))
+}
+
+// Value implements `driver.Valuer`, so that `Money` can be passed as a query
+// argument and written to a DECIMAL column
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan implements `sql.Scanner`, so that `Money` can be read from a DECIMAL
+// column
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case string:
+		return m.parse(v)
+	case []byte:
+		return m.parse(string(v))
+	case int64:
+		*m = Money(v * 100)
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+}
+
+// Parse a decimal string such as "12.5" into a number of cents
+// Digits beyond the second decimal place must be zero
+func (m *Money) parse(s string) error {
+	whole, frac, _ := strings.Cut(strings.TrimSpace(s), ".")
+	negative := strings.HasPrefix(whole, "-")
+	if len(frac) > 2 {
+		if strings.Trim(frac[2:], "0") != "" {
+			return fmt.Errorf("cannot represent %q as Money: more than two decimal places", s)
+		}
+		frac = frac[:2]
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return fmt.Errorf("cannot parse %q as Money: %w", s, err)
+	}
+	cents, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil || cents < 0 {
+		return fmt.Errorf("cannot parse %q as Money", s)
+	}
+	if negative {
+		cents = -cents
+	}
+	*m = Money(units*100 + cents)
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/cockroachlabs/example-app-go-gorm/store"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Serve a small REST API on `addr` until `ctx` is cancelled, and then shut
+// down, returning nil once the requests in progress have finished
+//
+//	GET  /accounts       lists the accounts, with optional ?limit= and ?offset=
+//	GET  /accounts/{id}  returns one account
+//	POST /transfers      transfers funds, given {"from": ..., "to": ..., "amount": ...}
+//	GET  /metrics        exposes the transfer metrics to Prometheus
+//
+// The handlers only use `accounts`, so they do not depend on how the accounts
+// are stored. With `store.NewGormAccountStore`, transfers go through
+// `store.TransferFunds` in `store.ExecuteTransfer`, like in the CLI mode. An
+// Idempotency-Key request header makes resubmitting a transfer safe. Every
+// request gets `timeout` to finish its queries, and every transfer runs with
+// `txOpts`
+func serve(ctx context.Context, accounts store.AccountStore, addr string, timeout time.Duration, txOpts *sql.TxOptions) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /accounts", func(w http.ResponseWriter, r *http.Request) {
+		var opts store.ListOptions
+		var err error
+		if v := r.URL.Query().Get("limit"); v != "" {
+			if opts.Limit, err = strconv.Atoi(v); err != nil || opts.Limit < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+				return
+			}
+		}
+		if v := r.URL.Query().Get("offset"); v != "" {
+			if opts.Offset, err = strconv.Atoi(v); err != nil || opts.Offset < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid offset %q", v))
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		page, err := accounts.List(ctx, opts)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, page)
+	})
+	mux.HandleFunc("GET /accounts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid account ID: %w", err))
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		account, err := accounts.GetByID(ctx, id)
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, account)
+	})
+	mux.HandleFunc("POST /transfers", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			From   uuid.UUID   `json:"from"`
+			To     uuid.UUID   `json:"to"`
+			Amount model.Money `json:"amount"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid transfer: %w", err))
+			return
+		}
+		if req.Amount <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("amount %s must be positive", req.Amount))
+			return
+		}
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			key = uuid.NewString()
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		if _, err := accounts.Transfer(ctx, txOpts, key, req.From, req.To, req.Amount); err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "key": key})
+	})
+
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	// Requests get their contexts from `ctx`, without its cancellation, so
+	// that their log messages carry the run ID, while `Shutdown` still lets
+	// the requests in progress finish
+	server := &http.Server{Addr: addr, Handler: mux, BaseContext: func(net.Listener) context.Context {
+		return context.WithoutCancel(ctx)
+	}}
+	// `Shutdown` waits for the requests in progress, but `ListenAndServe`
+	// returns as soon as it is called, so `serve` waits for `shutdownDone`
+	// before returning and letting the caller close the database
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.ErrorContext(ctx, "Shutting down server", "error", err)
+		}
+	}()
+	slog.InfoContext(ctx, "Serving REST API", "addr", addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-shutdownDone
+	// Being stopped by a signal is how the server is meant to end, so a
+	// clean shutdown is not an error. Any other end of `ctx` still is
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// Pick the HTTP status for an error returned by the account queries
+// Transfers that can never succeed as requested are the client's fault, while
+// anything else, including transactions that ran out of retries, is ours
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, store.ErrAccountNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, store.ErrSameAccount), errors.Is(err, store.ErrInvalidAmount):
+		return http.StatusBadRequest
+	case errors.Is(err, store.ErrInsufficientFunds), errors.Is(err, store.ErrBalanceLimit):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// Write `v` as the JSON body of a response with status `status`
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Writing response", "error", err)
+	}
+}
+
+// Write `err` as a {"error": ...} JSON response with status `status`
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestServeShutdownIsClean(t *testing.T) {
+	// The server is stopped before it starts, as by a Ctrl+C, so no
+	// request reaches the handlers and no account store is needed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := serve(ctx, nil, "127.0.0.1:0", time.Second, nil); err != nil {
+		t.Errorf("serve() after cancellation = %v, want nil", err)
+	}
+}
@@ -0,0 +1,609 @@
+// Package store holds the database operations of the example
+// Every function takes the `*gorm.DB` to run its queries on, which may be a
+// transaction started by `ExecuteTx` or a dry-run session
+package store
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// The number of customers `AddAccounts` spreads the new accounts across
+const numCustomers = 3
+
+// NewAccounts returns `numRows` new accounts, to be inserted with
+// `AddAccounts` or `AccountStore.Create`
+// Each account gets a new UUID and a random balance: a whole dollar amount
+// from `minBalance` up to but not including `maxBalance`, drawn from `rng`, so
+// a fixed seed produces the same balances
+// The first accounts are named after `names`, in order, and any further
+// accounts get generated labels such as "account 6"
+// Every account may be overdrawn by up to `overdraftLimit` whole dollars
+func NewAccounts(rng *rand.Rand, numRows int, minBalance int, maxBalance int, overdraftLimit int, names []string) []model.Account {
+	accounts := make([]model.Account, numRows)
+	for i := range accounts {
+		name := fmt.Sprintf("account %d", i+1)
+		if i < len(names) {
+			name = names[i]
+		}
+		accounts[i] = model.Account{
+			ID:             uuid.New(),
+			Name:           name,
+			Balance:        model.Dollars(minBalance + rng.Intn(maxBalance-minBalance)),
+			OverdraftLimit: model.Dollars(overdraftLimit),
+		}
+	}
+	return accounts
+}
+
+// AddAccounts inserts `accounts` into the "accounts" table, and returns their
+// IDs, which other functions use to track the accounts
+// It also creates a few rows in the "customers" table, and assigns each
+// account to one of them in turn, replacing any customer it had. The
+// customers are new on every call, so a transaction that is retried does not
+// refer to customers that were rolled back
+// Rows are sent in multi-row INSERT statements of up to `batchSize` rows, which
+// takes far fewer round trips to the cluster than one INSERT per row
+// Each time the number of rows inserted passes a multiple of
+// `progressEvery`, it is logged with the rate, so that a long seed shows
+// that it is progressing. A `progressEvery` of 0 disables these messages
+// If inserting stops early, because of an error or because `ctx` is
+// cancelled, the IDs of the accounts inserted so far are returned with the
+// error. Inside a transaction, those rows are rolled back along with it
+func AddAccounts(ctx context.Context, db *gorm.DB, accounts []model.Account, batchSize int, progressEvery int) ([]uuid.UUID, error) {
+	db = db.WithContext(ctx)
+	slog.InfoContext(ctx, "Creating accounts", "count", len(accounts))
+	customers := make([]model.Customer, min(numCustomers, len(accounts)))
+	for i := range customers {
+		customers[i] = model.Customer{ID: uuid.New(), Name: fmt.Sprintf("Customer %d", i+1)}
+	}
+	if len(customers) > 0 {
+		if err := db.Create(&customers).Error; err != nil {
+			return nil, err
+		}
+	}
+	for i := range accounts {
+		accounts[i].CustomerID = &customers[i%len(customers)].ID
+	}
+	start := time.Now()
+	for i := 0; i < len(accounts); i += batchSize {
+		// Stop between batches once the context is cancelled, e.g. by
+		// Ctrl+C, rather than sending the rest of a large seed first
+		select {
+		case <-ctx.Done():
+			return accountIDs(accounts[:i]), ctx.Err()
+		default:
+		}
+		end := min(i+batchSize, len(accounts))
+		if err := db.Create(accounts[i:end]).Error; err != nil {
+			return accountIDs(accounts[:i]), err
+		}
+		// Progress is logged whenever the batch crosses a multiple of
+		// `progressEvery`, so the batch size stays the one asked for
+		if progressEvery > 0 && end/progressEvery > i/progressEvery {
+			elapsed := time.Since(start)
+			slog.InfoContext(ctx, "Inserting accounts", "inserted", end, "total", len(accounts),
+				"rows_per_second", int(float64(end)/max(elapsed.Seconds(), 0.001)))
+		}
+	}
+	acctIDs := accountIDs(accounts)
+	slog.InfoContext(ctx, "Accounts created", "count", len(acctIDs))
+	return acctIDs, nil
+}
+
+// Report whether `err` means that a query found no row, as returned by
+// `First`, `Take`, and `Last`, rather than that the query failed
+func isNotFound(err error) bool {
+	return errors.Is(err, gorm.ErrRecordNotFound)
+}
+
+// accountNotFoundError is returned when there is no account with ID `id`
+// It matches `ErrAccountNotFound` with `errors.Is`, and reads as a message
+// fit for the user
+type accountNotFoundError struct {
+	id uuid.UUID
+}
+
+func (e *accountNotFoundError) Error() string {
+	return fmt.Sprintf("account %s does not exist", e.id)
+}
+
+func (e *accountNotFoundError) Is(target error) bool {
+	return target == ErrAccountNotFound
+}
+
+// Return the IDs of `accounts`, in order
+func accountIDs(accounts []model.Account) []uuid.UUID {
+	ids := make([]uuid.UUID, len(accounts))
+	for i, account := range accounts {
+		ids[i] = account.ID
+	}
+	return ids
+}
+
+// Wrap an error returned while loading the account with ID `id`
+// A missing row is reported as `ErrAccountNotFound`, separately from other
+// query failures such as a lost connection
+// Every query that loads a single account with `First` goes through here
+func lookupError(id uuid.UUID, err error) error {
+	if isNotFound(err) {
+		return &accountNotFoundError{id: id}
+	}
+	return fmt.Errorf("loading account %s: %w", id, err)
+}
+
+// GetAccount looks up the account with ID `id`
+// A missing account is reported as `ErrAccountNotFound`
+func GetAccount(ctx context.Context, db *gorm.DB, id uuid.UUID) (model.Account, error) {
+	var account model.Account
+	if err := db.WithContext(ctx).First(&account, id).Error; err != nil {
+		return model.Account{}, lookupError(id, err)
+	}
+	return account, nil
+}
+
+// GetBalance looks up the balance of the account with ID `id`
+func GetBalance(ctx context.Context, db *gorm.DB, id uuid.UUID) (model.Money, error) {
+	account, err := GetAccount(ctx, db, id)
+	if err != nil {
+		return 0, err
+	}
+	return account.Balance, nil
+}
+
+// TotalBalance returns the sum of the balances of all rows in "accounts" table
+func TotalBalance(ctx context.Context, db *gorm.DB) (model.Money, error) {
+	var total model.Money
+	if err := db.WithContext(ctx).Model(&model.Account{}).Select("COALESCE(SUM(balance), 0)").Scan(&total).Error; err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// Stats summarizes the rows in "accounts" table
+type Stats struct {
+	Accounts     int64       `json:"accounts"`
+	TotalBalance model.Money `json:"total_balance"`
+}
+
+// AccountStats counts the rows in "accounts" table and adds up their balances
+// Both come from the same statement, so they agree with each other even while
+// transfers run. An empty table gives zeros
+func AccountStats(ctx context.Context, db *gorm.DB) (Stats, error) {
+	var stats Stats
+	err := db.WithContext(ctx).Model(&model.Account{}).
+		Select("COUNT(*) AS accounts, COALESCE(SUM(balance), 0) AS total_balance").
+		Scan(&stats).Error
+	if err != nil {
+		return Stats{}, err
+	}
+	return stats, nil
+}
+
+// Accrue adds interest at `rate` to every row in "accounts" table with a
+// positive balance, and returns the total interest added
+// Overdrawn accounts are left as they are, since interest on a negative
+// balance would take them further below zero, and past their overdraft
+// limit, which the "balance_within_overdraft" CHECK constraint rejects
+// All balances are changed by a single UPDATE statement, which is meant to
+// run in a transaction, so that the totals read before and after it match
+// the change. The interest of each account is rounded down to whole cents.
+// Every account's version is incremented, like a transfer does, so transfers
+// that read an account before the update are retried
+// No balance is changed if any would end up above `maxBalance`
+func Accrue(ctx context.Context, db *gorm.DB, rate float64, maxBalance model.Money) (model.Money, error) {
+	slog.InfoContext(ctx, "Accruing interest", "rate", rate)
+	before, err := TotalBalance(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	// The rate is passed as a string and cast to DECIMAL, because
+	// CockroachDB does not multiply DECIMAL by FLOAT
+	newBalance := gorm.Expr("balance + FLOOR(balance * CAST(? AS DECIMAL) * 100) / 100", strconv.FormatFloat(rate, 'f', -1, 64))
+	// The new balances are checked in SQL, with DECIMAL arithmetic, before
+	// any is written, so a balance that would not fit is never scanned
+	var tooHigh int64
+	if err := db.WithContext(ctx).Model(&model.Account{}).Where("balance > 0").Where("? > ?", newBalance, maxBalance).Count(&tooHigh).Error; err != nil {
+		return 0, err
+	}
+	if tooHigh > 0 {
+		return 0, fmt.Errorf("interest at rate %v would take %d accounts above %s: %w", rate, tooHigh, maxBalance, ErrBalanceLimit)
+	}
+	result := db.WithContext(ctx).Model(&model.Account{}).Where("balance > 0").
+		Updates(map[string]interface{}{
+			"balance": newBalance,
+			"version": gorm.Expr("version + 1"),
+		})
+	if isCheckViolation(result.Error) {
+		return 0, fmt.Errorf("interest at rate %v: %w: %w", rate, ErrInsufficientFunds, result.Error)
+	}
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	after, err := TotalBalance(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	slog.InfoContext(ctx, "Interest accrued", "accounts", result.RowsAffected, "interest", (after - before).String())
+	return after - before, nil
+}
+
+// OverdrawnAccounts returns the rows in "accounts" table with a balance below
+// their overdraft limit
+// The "balance_within_overdraft" CHECK constraint should make this impossible,
+// so any row returned points to corrupted data, or to a table created before
+// the constraint existed
+func OverdrawnAccounts(ctx context.Context, db *gorm.DB) ([]model.Account, error) {
+	var accounts []model.Account
+	if err := db.WithContext(ctx).Where("balance + overdraft_limit < 0").Order("id").Find(&accounts).Error; err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// ListOptions selects which rows of the "accounts" table `ListAccounts` returns
+type ListOptions struct {
+	// At most `Limit` rows are returned after skipping the first `Offset`,
+	// and a `Limit` of 0 returns all remaining rows
+	Limit  int
+	Offset int
+	// When positive, the rows are read as they were `AsOf` ago with
+	// AS OF SYSTEM TIME. Such historical reads can be served by the
+	// closest replica, without waiting on writes in progress, but they
+	// are not allowed inside a transaction that writes
+	AsOf time.Duration
+	// When positive, only the rows updated within the last `ChangedSince`
+	// are returned, e.g. the accounts touched by a burst of transfers.
+	// "updated_at" is set by GORM from the client's clock, so the cutoff is
+	// too
+	ChangedSince time.Duration
+}
+
+// ListAccounts returns one page of rows from the "accounts" table, ordered by
+// ID so that pages are stable between calls
+func ListAccounts(ctx context.Context, db *gorm.DB, opts ListOptions) ([]model.Account, error) {
+	query, err := accountsQuery(ctx, db, opts)
+	if err != nil {
+		return nil, err
+	}
+	var accounts []model.Account
+	if err := query.Order("id").Find(&accounts).Error; err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// Build the query for the rows of the "accounts" table selected by `opts`,
+// without any order
+// With `opts.AsOf` set, the time to read at is resolved once, here, so that
+// every statement run from the query, such as each batch of
+// `FindInBatches`, reads the same snapshot
+func accountsQuery(ctx context.Context, db *gorm.DB, opts ListOptions) (*gorm.DB, error) {
+	query := db.WithContext(ctx)
+	if opts.AsOf > 0 {
+		readAt, err := readTimestamp(ctx, db, opts.AsOf)
+		if err != nil {
+			return nil, err
+		}
+		// The timestamp is an integer of nanoseconds, so it is safe to
+		// format into the statement. CockroachDB requires a constant here
+		table := db.NamingStrategy.TableName("Account")
+		query = query.Table(fmt.Sprintf("%s AS OF SYSTEM TIME '%d'", query.Statement.Quote(table), readAt.UnixNano()))
+		// GORM cannot work out the table name from such an expression, and
+		// needs it, without any prefix, to qualify column names
+		query.Statement.Table = table[strings.LastIndex(table, ".")+1:]
+	}
+	if opts.ChangedSince > 0 {
+		query = query.Where("updated_at > ?", time.Now().Add(-opts.ChangedSince))
+	}
+	query = query.Offset(opts.Offset)
+	if opts.Limit > 0 {
+		query = query.Limit(opts.Limit)
+	}
+	return query, nil
+}
+
+// Return the time `ago` before now, by the clock of the cluster rather than
+// of the client, to read at with AS OF SYSTEM TIME
+func readTimestamp(ctx context.Context, db *gorm.DB, ago time.Duration) (time.Time, error) {
+	var readAt time.Time
+	err := db.WithContext(ctx).Raw("SELECT now() - ? * INTERVAL '1 microsecond'", ago.Microseconds()).Row().Scan(&readAt)
+	return readAt, err
+}
+
+// PrintBalances prints IDs and balances for one page of rows in "accounts" table
+// With `output` set to "json", the rows are printed as a JSON array of
+// {"id": ..., "name": ..., "balance": ..., "overdraft_limit": ...} objects
+// instead
+// Rows are read `batchSize` at a time with `FindInBatches`, ordered by ID, and
+// each batch is printed as soon as it arrives, so memory use does not grow
+// with the size of the table
+// A query that fails stops the printout, and its error is returned
+func PrintBalances(ctx context.Context, db *gorm.DB, opts ListOptions, output string, batchSize int) error {
+	if output == "json" {
+		fmt.Print("[")
+	} else {
+		fmt.Printf("Balance at '%s':\n", time.Now())
+	}
+	query, err := accountsQuery(ctx, db, opts)
+	if err != nil {
+		return err
+	}
+	var accounts []model.Account
+	rows := 0
+	result := query.FindInBatches(&accounts, batchSize, func(tx *gorm.DB, batch int) error {
+		for _, account := range accounts {
+			if output == "json" {
+				if rows > 0 {
+					fmt.Print(",")
+				}
+				data, err := json.Marshal(newBalance(account))
+				if err != nil {
+					return err
+				}
+				fmt.Print(string(data))
+			} else {
+				printBalanceLine(account)
+			}
+			rows++
+		}
+		return nil
+	})
+	if output == "json" {
+		fmt.Println("]")
+	}
+	return result.Error
+}
+
+// The JSON form of an account in the balance printouts
+type balance struct {
+	ID             uuid.UUID   `json:"id"`
+	Name           string      `json:"name"`
+	Balance        model.Money `json:"balance"`
+	OverdraftLimit model.Money `json:"overdraft_limit"`
+}
+
+// Convert `account` to its JSON form in the balance printouts
+func newBalance(account model.Account) balance {
+	return balance{ID: account.ID, Name: account.Name, Balance: account.Balance, OverdraftLimit: account.OverdraftLimit}
+}
+
+// Print one account in the text form of the balance printouts
+func printBalanceLine(account model.Account) {
+	fmt.Printf("%s %-12s %s (limit %s, updated %s)\n", account.ID, account.Name, account.Balance, account.OverdraftLimit, account.UpdatedAt.Format(time.RFC3339))
+}
+
+// PrintTopAccounts prints the `n` rows in "accounts" table with the highest
+// balances, highest first, or with the lowest balances, lowest first, if
+// `asc` is set
+// The rows are printed like `PrintBalances` does, as text or, with `output`
+// set to "json", as a JSON array
+func PrintTopAccounts(ctx context.Context, db *gorm.DB, n int, asc bool, output string) error {
+	order := "balance DESC"
+	if asc {
+		order = "balance ASC"
+	}
+	var accounts []model.Account
+	// Ties are broken by ID, so that the same rows are printed every time
+	if err := db.WithContext(ctx).Order(order).Order("id").Limit(n).Find(&accounts).Error; err != nil {
+		return err
+	}
+	if output == "json" {
+		out := make([]balance, len(accounts))
+		for i, account := range accounts {
+			out[i] = newBalance(account)
+		}
+		return printJSON(out)
+	}
+	if asc {
+		fmt.Printf("Lowest %d balances:\n", n)
+	} else {
+		fmt.Printf("Highest %d balances:\n", n)
+	}
+	for _, account := range accounts {
+		printBalanceLine(account)
+	}
+	return nil
+}
+
+// PrintTransfers prints the rows in "transfers" table created at or after
+// `since`, oldest first, so that a run prints its own transfers rather than
+// the whole ledger
+// With `output` set to "json", the rows are printed as a JSON array instead
+func PrintTransfers(ctx context.Context, db *gorm.DB, since time.Time, output string) error {
+	var transfers []model.Transfer
+	if err := db.WithContext(ctx).Where("created_at >= ?", since).Order("created_at").Find(&transfers).Error; err != nil {
+		return err
+	}
+	if output == "json" {
+		type transfer struct {
+			ID        uuid.UUID   `json:"id"`
+			FromID    uuid.UUID   `json:"from"`
+			ToID      uuid.UUID   `json:"to"`
+			Amount    model.Money `json:"amount"`
+			CreatedAt time.Time   `json:"created_at"`
+		}
+		out := make([]transfer, len(transfers))
+		for i, t := range transfers {
+			out[i] = transfer(t)
+		}
+		return printJSON(out)
+	}
+	fmt.Println("Transfers:")
+	for _, transfer := range transfers {
+		fmt.Printf("%s %s -> %s %s\n", transfer.CreatedAt.Format(time.RFC3339), transfer.FromID, transfer.ToID, transfer.Amount)
+	}
+	return nil
+}
+
+// ExportCSV writes the ID and balance of every row in "accounts" table to a
+// CSV file at `path`
+// Rows are read `batchSize` at a time with `FindInBatches`, so memory use does
+// not grow with the size of the table
+func ExportCSV(ctx context.Context, db *gorm.DB, path string, batchSize int) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"id", "balance"}); err != nil {
+		return err
+	}
+	var accounts []model.Account
+	rows := 0
+	result := db.WithContext(ctx).FindInBatches(&accounts, batchSize, func(tx *gorm.DB, batch int) error {
+		for _, account := range accounts {
+			if err := w.Write([]string{account.ID.String(), account.Balance.String()}); err != nil {
+				return err
+			}
+		}
+		rows += len(accounts)
+		return nil
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Accounts exported", "path", path, "count", rows)
+	return nil
+}
+
+// PrintCustomerBalances prints every customer with the total balance of their
+// accounts
+// `Preload` fetches the accounts of all customers in one extra query, rather
+// than one query per customer
+func PrintCustomerBalances(ctx context.Context, db *gorm.DB, output string) error {
+	var customers []model.Customer
+	if err := db.WithContext(ctx).Preload("Accounts").Order("name").Find(&customers).Error; err != nil {
+		return err
+	}
+	type customerTotal struct {
+		ID       uuid.UUID   `json:"id"`
+		Name     string      `json:"name"`
+		Accounts int         `json:"accounts"`
+		Total    model.Money `json:"total"`
+	}
+	totals := make([]customerTotal, len(customers))
+	for i, customer := range customers {
+		totals[i] = customerTotal{ID: customer.ID, Name: customer.Name, Accounts: len(customer.Accounts)}
+		for _, account := range customer.Accounts {
+			totals[i].Total += account.Balance
+		}
+	}
+	if output == "json" {
+		return printJSON(totals)
+	}
+	fmt.Println("Customer balances:")
+	for _, total := range totals {
+		fmt.Printf("%s %s: %s across %d accounts\n", total.ID, total.Name, total.Total, total.Accounts)
+	}
+	return nil
+}
+
+// Write `v` to stdout as a single line of JSON
+func printJSON(v interface{}) error {
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// PrintError prints `err`, which failed a transfer or a whole command
+// With `output` set to "json", it is written to stderr as a
+// {"error": ..., "code": ...} object instead, with the code from
+// `ErrorCode`, so that stdout only holds the JSON of the results
+func PrintError(err error, output string) {
+	if output != "json" {
+		fmt.Println(err)
+		return
+	}
+	type jsonError struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if err := json.NewEncoder(os.Stderr).Encode(jsonError{Error: err.Error(), Code: ErrorCode(err)}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// DeleteAccounts deletes all rows in "accounts" table with an ID in
+// `accountIDs`, along with the customers that own them and no other account
+// The rows are soft-deleted by setting "deleted_at", unless `hard` is set, in
+// which case they are removed from the table
+// A customer with another account left is kept. After a soft delete, only
+// accounts that are not deleted count, so the customer goes with its last
+// live account. A hard delete keeps every customer still referenced by a row,
+// soft-deleted or not, since the foreign key from "accounts" would reject
+// removing it
+func DeleteAccounts(ctx context.Context, db *gorm.DB, accountIDs []uuid.UUID, hard bool) error {
+	slog.InfoContext(ctx, "Deleting accounts", "count", len(accountIDs), "hard", hard)
+	db = db.WithContext(ctx)
+	if hard {
+		db = db.Unscoped()
+	}
+	// Find the owners before their accounts are gone
+	var customerIDs []uuid.UUID
+	if err := db.Model(&model.Account{}).Distinct().Where("id IN ? AND customer_id IS NOT NULL", accountIDs).Pluck("customer_id", &customerIDs).Error; err != nil {
+		return err
+	}
+	err := db.Where("id IN ?", accountIDs).Delete(model.Account{}).Error
+	if err != nil {
+		return err
+	}
+	if len(customerIDs) > 0 {
+		remaining := fmt.Sprintf("SELECT 1 FROM %s AS a WHERE a.customer_id = %s.id",
+			db.Statement.Quote(db.NamingStrategy.TableName("Account")), db.Statement.Quote(customerTable(db)))
+		if !hard {
+			remaining += " AND a.deleted_at IS NULL"
+		}
+		if err := db.Where("id IN ? AND NOT EXISTS ("+remaining+")", customerIDs).Delete(model.Customer{}).Error; err != nil {
+			return err
+		}
+	}
+	slog.InfoContext(ctx, "Accounts deleted", "count", len(accountIDs))
+	return nil
+}
+
+// Return the name of the "customers" table without any prefix, which is how
+// a statement on it refers to its columns
+func customerTable(db *gorm.DB) string {
+	table := db.NamingStrategy.TableName("Customer")
+	return table[strings.LastIndex(table, ".")+1:]
+}
+
+// TruncateAccounts removes every row from the "accounts" and "customers"
+// tables, whichever run created them
+// Unlike `DeleteAccounts`, it leaves no soft-deleted rows behind, and it
+// cannot be undone
+func TruncateAccounts(ctx context.Context, db *gorm.DB) error {
+	accounts := db.NamingStrategy.TableName("Account")
+	customers := db.NamingStrategy.TableName("Customer")
+	slog.WarnContext(ctx, "Truncating tables", "tables", []string{accounts, customers})
+	// Both tables go in one statement, since "accounts" has a foreign key to
+	// "customers"
+	err := db.WithContext(ctx).Exec(fmt.Sprintf("TRUNCATE %s, %s", db.Statement.Quote(accounts), db.Statement.Quote(customers))).Error
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Tables truncated", "tables", []string{accounts, customers})
+	return nil
+}
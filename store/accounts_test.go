@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// The statements `Accrue` runs, in order, as GORM generates them. Only
+// accounts with a positive balance are counted and updated
+const (
+	totalBalanceSQL = `SELECT COALESCE(SUM(balance), 0) FROM "accounts" WHERE "accounts"."deleted_at" IS NULL`
+	countTooHighSQL = `SELECT count(*) FROM "accounts" WHERE balance > 0 AND balance + FLOOR(balance * CAST($1 AS DECIMAL) * 100) / 100 > $2 AND "accounts"."deleted_at" IS NULL`
+	accrueSQL       = `UPDATE "accounts" SET "balance"=balance + FLOOR(balance * CAST($1 AS DECIMAL) * 100) / 100,"version"=version + 1,"updated_at"=$2 WHERE balance > 0 AND "accounts"."deleted_at" IS NULL`
+)
+
+func TestAccrue(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectQuery(totalBalanceSQL).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("100.00"))
+	mock.ExpectQuery(countTooHighSQL).WithArgs("0.05", DefaultMaxBalance).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(accrueSQL).WithArgs("0.05", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery(totalBalanceSQL).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("105.00"))
+
+	interest, err := Accrue(context.Background(), db, 0.05, DefaultMaxBalance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interest != model.Dollars(5) {
+		t.Errorf("Accrue() = %s, want %s", interest, model.Dollars(5))
+	}
+}
+
+func TestAccrueBalanceCap(t *testing.T) {
+	db, mock := newMockDB(t)
+	maxBalance := model.Dollars(1000)
+	mock.ExpectQuery(totalBalanceSQL).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("1000.00"))
+	mock.ExpectQuery(countTooHighSQL).WithArgs("0.05", maxBalance).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	if _, err := Accrue(context.Background(), db, 0.05, maxBalance); !errors.Is(err, ErrBalanceLimit) {
+		t.Fatalf("Accrue() error = %v, want %v", err, ErrBalanceLimit)
+	}
+}
+
+func TestAccrueCheckViolation(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectQuery(totalBalanceSQL).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("100.00"))
+	mock.ExpectQuery(countTooHighSQL).WithArgs("0.05", DefaultMaxBalance).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(accrueSQL).WithArgs("0.05", sqlmock.AnyArg()).
+		WillReturnError(&pgconn.PgError{Code: "23514", ConstraintName: "balance_within_overdraft"})
+
+	if _, err := Accrue(context.Background(), db, 0.05, DefaultMaxBalance); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("Accrue() error = %v, want %v", err, ErrInsufficientFunds)
+	}
+}
+
+// The statements `PrintBalances` runs with `AsOf` set and batches of one row:
+// the read time is resolved first, and then every batch reads at that same
+// time
+const (
+	readTimestampSQL = `SELECT now() - $1 * INTERVAL '1 microsecond'`
+	firstBatchSQL    = `SELECT * FROM "accounts" AS OF SYSTEM TIME '1700000000123456000' WHERE "accounts"."deleted_at" IS NULL ORDER BY "accounts"."id" LIMIT $1`
+	nextBatchSQL     = `SELECT * FROM "accounts" AS OF SYSTEM TIME '1700000000123456000' WHERE "accounts"."id" > $1 AND "accounts"."deleted_at" IS NULL ORDER BY "accounts"."id" LIMIT $2`
+)
+
+func TestPrintBalancesAsOfReadsOneSnapshot(t *testing.T) {
+	db, mock := newMockDB(t)
+	id := uuid.New()
+	mock.ExpectQuery(readTimestampSQL).WithArgs((10 * time.Second).Microseconds()).
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(time.Unix(0, 1700000000123456000)))
+	mock.ExpectQuery(firstBatchSQL).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "balance"}).AddRow(id, "1.00"))
+	mock.ExpectQuery(nextBatchSQL).WithArgs(id, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "balance"}))
+
+	if err := PrintBalances(context.Background(), db, ListOptions{AsOf: 10 * time.Second}, "text", 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteAccountsKeepsCustomersWithOtherAccounts(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	customer := model.Customer{ID: uuid.New(), Name: "Customer with two accounts"}
+	if err := db.Create(&customer).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Unscoped().Delete(&customer) })
+	ids := createTestAccounts(t, db, model.Dollars(100), model.Dollars(100))
+	if err := db.Model(&model.Account{}).Where("id IN ?", ids).Update("customer_id", customer.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting the first account leaves the other one, and so the customer.
+	// Deleting the second takes the customer with it
+	for i, want := range []int64{1, 0} {
+		if _, err := ExecuteTx(ctx, db, nil, func(tx *gorm.DB) error {
+			return DeleteAccounts(ctx, tx, ids[i:i+1], false)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		var customers int64
+		if err := db.Model(&model.Customer{}).Where("id = ?", customer.ID).Count(&customers).Error; err != nil {
+			t.Fatal(err)
+		}
+		if customers != want {
+			t.Errorf("after deleting account %d, found %d customers, want %d", i+1, customers, want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// The environment variable holding the connection string of the cluster that
+// the database tests and benchmarks run against, e.g.
+// "postgresql://root@localhost:26257/defaultdb?sslmode=disable"
+// They are skipped when it is not set
+const testDatabaseEnv = "COCKROACH_URL"
+
+// The transfers log every call, which would bury the test output
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// Connect to the cluster named by `testDatabaseEnv`, and create the tables,
+// or skip the test if the variable is not set
+func openTestDB(tb testing.TB) *gorm.DB {
+	tb.Helper()
+	dsn := os.Getenv(testDatabaseEnv)
+	if dsn == "" {
+		tb.Skipf("%s is not set", testDatabaseEnv)
+	}
+	return openDB(tb, dsn)
+}
+
+// Connect to the cluster at `dsn`, and create the tables
+// The connection is closed when the test ends
+func openDB(tb testing.TB, dsn string) *gorm.DB {
+	tb.Helper()
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&model.Customer{}, &model.Account{}, &model.Transfer{}, &model.IdempotencyKey{}); err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+// Insert one account per balance in `balances`, and return their IDs
+// The accounts are removed again when the test ends
+func createTestAccounts(tb testing.TB, db *gorm.DB, balances ...model.Money) []uuid.UUID {
+	tb.Helper()
+	accounts := make([]model.Account, len(balances))
+	for i, balance := range balances {
+		accounts[i] = model.Account{ID: uuid.New(), Balance: balance}
+	}
+	if err := db.Create(&accounts).Error; err != nil {
+		tb.Fatal(err)
+	}
+	ids := make([]uuid.UUID, len(accounts))
+	for i, account := range accounts {
+		ids[i] = account.ID
+	}
+	tb.Cleanup(func() {
+		db.Unscoped().Where("from_id IN ? OR to_id IN ?", ids, ids).Delete(&model.Transfer{})
+		db.Unscoped().Delete(&model.Account{}, ids)
+	})
+	return ids
+}
+
+// Return the balance of account `id`, failing the test if it cannot be read
+func testBalance(tb testing.TB, db *gorm.DB, id uuid.UUID) model.Money {
+	tb.Helper()
+	balance, err := GetBalance(context.Background(), db, id)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return balance
+}
+
+// An account created without an ID gets one from the column default, which
+// `AutoMigrate` sets from the model's tag, so the tables are created in a
+// schema of their own instead of reusing ones from an earlier migration
+func TestCreateAccountWithoutIDGetsDefault(t *testing.T) {
+	admin := openTestDB(t)
+	name := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "_")
+	if err := admin.Exec("CREATE SCHEMA " + name).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + name + " CASCADE") })
+	// GORM caches the parsed models per connection, so the prefixed table
+	// names need a connection of their own
+	db, err := gorm.Open(postgres.Open(os.Getenv(testDatabaseEnv)), &gorm.Config{
+		Logger:         logger.Discard,
+		NamingStrategy: schema.NamingStrategy{TablePrefix: name + "."},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&model.Customer{}, &model.Account{}); err != nil {
+		t.Fatal(err)
+	}
+
+	account := model.Account{Balance: model.Dollars(100)}
+	if err := db.Create(&account).Error; err != nil {
+		t.Fatal(err)
+	}
+	if account.ID == uuid.Nil {
+		t.Error("Create() left the account ID zero, want one filled in by the database")
+	}
+}
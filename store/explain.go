@@ -0,0 +1,57 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// A GORM logger that keeps the SQL of every statement it is given, with the
+// arguments filled in, and logs nothing
+type sqlRecorder struct {
+	logger.Interface
+	statements []string
+}
+
+func (r *sqlRecorder) LogMode(logger.LogLevel) logger.Interface {
+	return r
+}
+
+func (r *sqlRecorder) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	sql, _ := fc()
+	r.statements = append(r.statements, sql)
+}
+
+// ExplainTransfer prints CockroachDB's plan for each statement that
+// `TransferFunds` would run to move `amount` from `fromID` to `toID`, without
+// transferring anything
+// The statements are built by running the transfer in a dry-run session, so
+// they are exactly the ones GORM generates. Each one is then sent to the
+// database prefixed with EXPLAIN, which plans the statement without running
+// it. The plans show, e.g., whether the lookups by ID use the primary key
+// The balance checks are skipped in a dry run, so no balance cap is needed
+func ExplainTransfer(ctx context.Context, db *gorm.DB, fromID uuid.UUID, toID uuid.UUID, amount model.Money) error {
+	recorder := &sqlRecorder{Interface: db.Logger}
+	dryRun := db.Session(&gorm.Session{DryRun: true, Logger: recorder})
+	if err := TransferFunds(ctx, dryRun, uuid.NewString(), fromID, toID, amount, DefaultMaxBalance); err != nil {
+		return err
+	}
+	for i, statement := range recorder.statements {
+		var plan []string
+		if err := db.WithContext(ctx).Raw("EXPLAIN " + statement).Scan(&plan).Error; err != nil {
+			return fmt.Errorf("explaining statement %d: %w", i+1, err)
+		}
+		fmt.Printf("Statement %d: %s\n", i+1, statement)
+		for _, line := range plan {
+			fmt.Println("  " + strings.TrimRight(line, " "))
+		}
+		fmt.Println()
+	}
+	return nil
+}
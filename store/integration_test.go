@@ -0,0 +1,87 @@
+//go:build integration
+
+package store
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/google/uuid"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"gorm.io/gorm"
+)
+
+// The environment variable naming the CockroachDB image that the
+// integration tests start with testcontainers, e.g.
+// "cockroachdb/cockroach:latest-v24.3". The tests are built only with the
+// "integration" tag, and skipped when it is not set:
+//
+//	COCKROACH_IMAGE=cockroachdb/cockroach:latest-v24.3 go test -tags integration ./store
+const testImageEnv = "COCKROACH_IMAGE"
+
+// Start a single-node CockroachDB container, and connect to it
+// The container is removed when the test ends
+func startCockroach(t *testing.T) *gorm.DB {
+	t.Helper()
+	image := os.Getenv(testImageEnv)
+	if image == "" {
+		t.Skipf("%s is not set", testImageEnv)
+	}
+	ctx := context.Background()
+	container, err := testcontainers.Run(ctx, image,
+		testcontainers.WithCmd("start-single-node", "--insecure"),
+		testcontainers.WithExposedPorts("26257/tcp", "8080/tcp"),
+		// The node only answers this once it accepts SQL connections
+		testcontainers.WithWaitStrategy(wait.ForHTTP("/health?ready=1").WithPort("8080/tcp")),
+	)
+	testcontainers.CleanupContainer(t, container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := container.PortEndpoint(ctx, "26257/tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openDB(t, "postgresql://root@"+addr+"/defaultdb?sslmode=disable")
+}
+
+func TestIntegrationTransfer(t *testing.T) {
+	db := startCockroach(t)
+	ctx := context.Background()
+	ids := createTestAccounts(t, db, model.Dollars(100), model.Dollars(250))
+	totalBefore, err := TotalBalance(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := uuid.NewString()
+	if _, err := ExecuteTx(ctx, db, nil, func(tx *gorm.DB) error {
+		return TransferFunds(ctx, tx, key, ids[0], ids[1], model.Dollars(40), DefaultMaxBalance)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testBalance(t, db, ids[0]); got != model.Dollars(60) {
+		t.Errorf("source balance = %s, want %s", got, model.Dollars(60))
+	}
+	if got := testBalance(t, db, ids[1]); got != model.Dollars(290) {
+		t.Errorf("destination balance = %s, want %s", got, model.Dollars(290))
+	}
+	totalAfter, err := TotalBalance(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totalAfter != totalBefore {
+		t.Errorf("total balance = %s after the transfer, want %s as before", totalAfter, totalBefore)
+	}
+	var transfers []model.Transfer
+	if err := db.Where("from_id = ? AND to_id = ?", ids[0], ids[1]).Find(&transfers).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(transfers) != 1 || transfers[0].Amount != model.Dollars(40) {
+		t.Errorf("transfers = %+v, want one of %s", transfers, model.Dollars(40))
+	}
+}
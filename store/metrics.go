@@ -0,0 +1,41 @@
+package store
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The Prometheus metrics of the store, registered with the default registry
+// The transfer counters and the latency histogram are updated once per
+// transaction by `ExecuteTransfer` and `TransferBatch`, so a transfer that
+// `ExecuteTx` retries is still counted once. The retries themselves show up
+// in `txAttempts`
+var (
+	transfersAttempted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "bank",
+		Name:      "transfers_attempted_total",
+		Help:      "Number of transfers started.",
+	})
+	transfersSucceeded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "bank",
+		Name:      "transfers_succeeded_total",
+		Help:      "Number of transfers that finished without an error, including those skipped as already processed.",
+	})
+	transfersFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bank",
+		Name:      "transfers_failed_total",
+		Help:      "Number of transfers that returned an error, by whether the transfer was rejected or failed in the database.",
+	}, []string{"reason"})
+	transferDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "bank",
+		Name:      "transfer_duration_seconds",
+		Help:      "Time taken by the transaction of a transfer or a batch of transfers, including its retries and the commit.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	txAttempts = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "bank",
+		Name:      "transaction_attempts",
+		Help:      "Number of times a transaction ran before it committed or gave up.",
+		Buckets:   []float64{1, 2, 3, 5, 10, 20},
+	})
+)
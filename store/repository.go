@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// AccountStore is the set of account operations that callers can depend on
+// without knowing how the accounts are stored, e.g. to swap in a fake in
+// tests
+// Unlike the functions of this package, its methods do not take a
+// `*gorm.DB`, and each one runs on its own, so none of them can be made part
+// of a caller's transaction
+type AccountStore interface {
+	// Create inserts `accounts` in a transaction, like `AddAccounts`, and
+	// returns the number of transaction attempts
+	Create(ctx context.Context, accounts []model.Account) (int, error)
+	// GetByID returns the account with ID `id`, or an error matching
+	// `ErrAccountNotFound`
+	GetByID(ctx context.Context, id uuid.UUID) (model.Account, error)
+	// List returns the page of accounts selected by `opts`, ordered by ID
+	List(ctx context.Context, opts ListOptions) ([]model.Account, error)
+	// Transfer moves `amount` from `fromID` to `toID` in a transaction
+	// with `opts`, like `TransferFunds`, and returns the number of
+	// transaction attempts
+	Transfer(ctx context.Context, opts *sql.TxOptions, idempotencyKey string, fromID uuid.UUID, toID uuid.UUID, amount model.Money) (int, error)
+	// DeleteByIDs deletes the accounts with an ID in `ids` in a
+	// transaction, like `DeleteAccounts`, and returns the number of
+	// transaction attempts
+	DeleteByIDs(ctx context.Context, ids []uuid.UUID, hard bool) (int, error)
+}
+
+// The number of rows `GormAccountStore.Create` sends per INSERT unless its
+// `BatchSize` is changed, the same as the default of `-batch-size`
+const DefaultBatchSize = 1000
+
+// GormAccountStore is the `AccountStore` backed by the functions of this
+// package, which run their queries with GORM
+// Its exported fields can be changed after `NewGormAccountStore`, before the
+// store is used
+type GormAccountStore struct {
+	db *gorm.DB
+	// Transfers may not take a balance above `MaxBalance`
+	MaxBalance model.Money
+	// `Create` inserts `BatchSize` rows per INSERT, and logs its progress
+	// every `ProgressEvery` rows, or not at all if it is 0
+	BatchSize     int
+	ProgressEvery int
+}
+
+// NewGormAccountStore returns an `AccountStore` that runs its queries on `db`
+// Transfers are capped at `DefaultMaxBalance`, and inserts are sent
+// `DefaultBatchSize` rows at a time without logging their progress
+func NewGormAccountStore(db *gorm.DB) *GormAccountStore {
+	return &GormAccountStore{db: db, MaxBalance: DefaultMaxBalance, BatchSize: DefaultBatchSize}
+}
+
+func (s *GormAccountStore) Create(ctx context.Context, accounts []model.Account) (int, error) {
+	return ExecuteTx(ctx, s.db, nil,
+		func(tx *gorm.DB) error {
+			_, err := AddAccounts(ctx, tx, accounts, s.BatchSize, s.ProgressEvery)
+			return err
+		},
+	)
+}
+
+func (s *GormAccountStore) GetByID(ctx context.Context, id uuid.UUID) (model.Account, error) {
+	return GetAccount(ctx, s.db, id)
+}
+
+func (s *GormAccountStore) List(ctx context.Context, opts ListOptions) ([]model.Account, error) {
+	return ListAccounts(ctx, s.db, opts)
+}
+
+func (s *GormAccountStore) Transfer(ctx context.Context, opts *sql.TxOptions, idempotencyKey string, fromID uuid.UUID, toID uuid.UUID, amount model.Money) (int, error) {
+	return ExecuteTransfer(ctx, s.db, opts,
+		func(tx *gorm.DB) error {
+			return TransferFunds(ctx, tx, idempotencyKey, fromID, toID, amount, s.MaxBalance)
+		},
+	)
+}
+
+// DeleteByIDs runs the deletes in one transaction, so the accounts and their
+// customers are deleted together or not at all
+func (s *GormAccountStore) DeleteByIDs(ctx context.Context, ids []uuid.UUID, hard bool) (int, error) {
+	return ExecuteTx(ctx, s.db, nil,
+		func(tx *gorm.DB) error {
+			return DeleteAccounts(ctx, tx, ids, hard)
+		},
+	)
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// The single statement of `TransferFundsReturning`. The "%[n]s" verbs are the
+// quoted names of the "transfer_requests", "accounts", and "transfers" tables
+// Both balances change in one UPDATE, since CockroachDB does not let a
+// statement modify the same table twice. The outer LEFT JOIN makes the
+// statement return a row even when no account was updated, so that
+// "recorded" tells an already processed request from missing accounts. The
+// casts give the placeholders of the INSERT ... SELECT types, which nothing
+// else in it does
+const transferReturningSQL = `WITH recorded AS (
+	INSERT INTO %[1]s ("key", created_at) VALUES (@key, @now)
+	ON CONFLICT DO NOTHING
+	RETURNING "key"
+), updated AS (
+	UPDATE %[2]s
+	SET balance = CASE WHEN id = @from THEN balance - @amount ELSE balance + @amount END,
+		version = version + 1,
+		updated_at = @now
+	WHERE id IN (@from, @to) AND deleted_at IS NULL AND EXISTS (SELECT 1 FROM recorded)
+	RETURNING id, balance, overdraft_limit
+), logged AS (
+	INSERT INTO %[3]s (id, from_id, to_id, amount, created_at)
+	SELECT @id::UUID, @from::UUID, @to::UUID, @amount::DECIMAL, @now::TIMESTAMPTZ
+	WHERE (SELECT count(*) FROM updated) = 2
+	RETURNING id
+)
+SELECT EXISTS (SELECT 1 FROM recorded) AS recorded, u.id, u.balance, u.overdraft_limit
+FROM (SELECT 1) AS one LEFT JOIN updated AS u ON true`
+
+// One row returned by `transferReturningSQL`. The account columns are NULL
+// when no account was updated
+type transferReturningRow struct {
+	Recorded       bool
+	ID             uuid.NullUUID
+	Balance        *model.Money
+	OverdraftLimit *model.Money
+}
+
+// TransferFundsReturning moves funds between accounts like `TransferFunds`,
+// but in a single statement, and so a single round trip to the cluster
+// Instead of reading both rows first, it records `idempotencyKey`, debits
+// `fromID`, credits `toID`, and logs the transfer with data-modifying common
+// table expressions, and checks the new balances that the UPDATE returns. A
+// balance that is too low or too high, or an account that was not updated,
+// fails the call, and the surrounding transaction must then be rolled back,
+// as `ExecuteTx` does, to undo the other account's change
+// A too low balance is usually caught by the "balance_within_overdraft"
+// CHECK constraint before any row is returned
+// In a dry run the statement is only printed, so no balance is checked
+// Like `TransferFunds`, it is counted in the transfer metrics by
+// `ExecuteTransfer`
+func TransferFundsReturning(ctx context.Context, db *gorm.DB, idempotencyKey string, fromID uuid.UUID, toID uuid.UUID, amount model.Money, maxBalance model.Money) error {
+	slog.InfoContext(ctx, "Transferring funds in one statement", "amount", amount.String(), "from", fromID, "to", toID, "key", idempotencyKey)
+	db = db.WithContext(ctx)
+	if amount <= 0 {
+		return fmt.Errorf("%w, got %s", ErrInvalidAmount, amount)
+	}
+	if fromID == toID {
+		return fmt.Errorf("%w %s", ErrSameAccount, fromID)
+	}
+
+	stmt := fmt.Sprintf(transferReturningSQL,
+		db.Statement.Quote(db.NamingStrategy.TableName("TransferRequest")),
+		db.Statement.Quote(db.NamingStrategy.TableName("Account")),
+		db.Statement.Quote(db.NamingStrategy.TableName("Transfer")),
+	)
+	var rows []transferReturningRow
+	err := db.Raw(stmt, map[string]interface{}{
+		"key":    idempotencyKey,
+		"now":    time.Now(),
+		"from":   fromID,
+		"to":     toID,
+		"amount": amount,
+		"id":     uuid.New(),
+	}).Scan(&rows).Error
+	// GORM logs the statement of a dry run, but cannot scan its result
+	if db.DryRun {
+		return nil
+	}
+	if isCheckViolation(err) {
+		return fmt.Errorf("account %s: %w: %w", fromID, ErrInsufficientFunds, err)
+	}
+	if err != nil {
+		return err
+	}
+	if len(rows) > 0 && !rows[0].Recorded {
+		slog.InfoContext(ctx, "Transfer already processed", "key", idempotencyKey)
+		return nil
+	}
+
+	updated := map[uuid.UUID]transferReturningRow{}
+	for _, row := range rows {
+		if row.ID.Valid {
+			updated[row.ID.UUID] = row
+		}
+	}
+	from, ok := updated[fromID]
+	if !ok {
+		return &accountNotFoundError{id: fromID}
+	}
+	to, ok := updated[toID]
+	if !ok {
+		return &accountNotFoundError{id: toID}
+	}
+	// A table created by hand, like the one in the README, may let the
+	// columns be NULL, and a NULL balance cannot be checked
+	for _, row := range []transferReturningRow{from, to} {
+		if row.Balance == nil || row.OverdraftLimit == nil {
+			return fmt.Errorf("account %s has a NULL balance or overdraft limit", row.ID.UUID)
+		}
+	}
+	if *from.Balance < -*from.OverdraftLimit {
+		return fmt.Errorf("account %s balance %s would be below its overdraft limit %s after transfer amount %s: %w", fromID, *from.Balance, *from.OverdraftLimit, amount, ErrInsufficientFunds)
+	}
+	if *to.Balance > maxBalance {
+		return fmt.Errorf("account %s balance %s after transfer amount %s is above %s: %w", toID, *to.Balance, amount, maxBalance, ErrBalanceLimit)
+	}
+	slog.InfoContext(ctx, "Funds transferred", "amount", amount.String(), "from", fromID, "to", toID)
+	return nil
+}
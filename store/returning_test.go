@@ -0,0 +1,30 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func TestTransferFundsReturningNullBalance(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	ids := createTestAccounts(t, db, model.Dollars(100), model.Dollars(100))
+	if err := db.Model(&model.Account{}).Where("id = ?", ids[1]).Update("balance", gorm.Expr("NULL")).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ExecuteTx(ctx, db, nil, func(tx *gorm.DB) error {
+		return TransferFundsReturning(ctx, tx, uuid.NewString(), ids[0], ids[1], model.Dollars(10), DefaultMaxBalance)
+	})
+	if err == nil || !strings.Contains(err.Error(), "NULL") {
+		t.Fatalf("TransferFundsReturning() error = %v, want a NULL balance error", err)
+	}
+	if got := testBalance(t, db, ids[0]); got != model.Dollars(100) {
+		t.Errorf("source balance = %s, want it unchanged at %s", got, model.Dollars(100))
+	}
+}
@@ -0,0 +1,302 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/v2/crdb/crdbgorm"
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Errors returned for requests that can never succeed as made, such as a
+// transfer from an account that does not exist
+// `ExecuteTx` only retries errors that CockroachDB reports as retryable, so a
+// transfer failing with one of these is rolled back and returned at once.
+// Check for them with `errors.Is`
+var (
+	ErrSameAccount       = errors.New("cannot transfer to the same account")
+	ErrInvalidAmount     = errors.New("transfer amount must be positive")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrAccountNotFound   = errors.New("account not found")
+	ErrBalanceLimit      = errors.New("balance would exceed the maximum")
+)
+
+// ErrorCode returns a short, stable name for the kind of error `err` is, for
+// output read by programs, such as "insufficient_funds" for
+// `ErrInsufficientFunds`. Errors other than those above are "internal"
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrSameAccount):
+		return "same_account"
+	case errors.Is(err, ErrInvalidAmount):
+		return "invalid_amount"
+	case errors.Is(err, ErrInsufficientFunds):
+		return "insufficient_funds"
+	case errors.Is(err, ErrAccountNotFound):
+		return "not_found"
+	case errors.Is(err, ErrBalanceLimit):
+		return "balance_limit"
+	}
+	return "internal"
+}
+
+// DefaultMaxBalance is the default of the highest balance a transfer or
+// `Accrue` may leave in an account, which callers pass as `maxBalance`
+// It keeps balances far from the limits of `model.Money`, which counts cents
+// in an int64, and of the DECIMAL(19,2) column
+const DefaultMaxBalance model.Money = 1_000_000_000_000 * 100
+
+// IsRejected reports whether `err` is one of the errors above, as opposed to
+// a failure of the database or of a transaction that ran out of retries
+func IsRejected(err error) bool {
+	return errors.Is(err, ErrSameAccount) || errors.Is(err, ErrInvalidAmount) ||
+		errors.Is(err, ErrInsufficientFunds) || errors.Is(err, ErrAccountNotFound) ||
+		errors.Is(err, ErrBalanceLimit)
+}
+
+// TransferFunds moves funds between accounts
+// This function adds `amount` to the "balance" column of the row with the "id" column matching `toID`,
+// and removes `amount` from the "balance" column of the row with the "id" column matching `fromID`
+// Both rows are read with SELECT ... FOR UPDATE, which locks them until the surrounding
+// transaction commits or rolls back. Concurrent transfers touching the same accounts
+// therefore wait for this one instead of checking the balance against a stale value.
+// The balances are then changed with a single UPDATE statement each
+// In a dry run nothing is read from the database, so the balance check is skipped
+// `idempotencyKey` identifies the logical transfer request. It is recorded in
+// the same transaction as the balance changes, so a request that is submitted
+// again after it committed is skipped instead of being applied twice
+// The transfer is rejected if it would take the balance of `toID` above
+// `maxBalance`
+// It runs inside the caller's transaction, so it is not counted in the
+// transfer metrics; `ExecuteTransfer` counts the whole transaction instead
+func TransferFunds(ctx context.Context, db *gorm.DB, idempotencyKey string, fromID uuid.UUID, toID uuid.UUID, amount model.Money, maxBalance model.Money) error {
+	slog.InfoContext(ctx, "Transferring funds", "amount", amount.String(), "from", fromID, "to", toID, "key", idempotencyKey)
+	db = db.WithContext(ctx)
+	// A negative amount would move money from `toID` to `fromID`, skipping
+	// the balance check on `toID`, so it is rejected before any query runs
+	if amount <= 0 {
+		return fmt.Errorf("%w, got %s", ErrInvalidAmount, amount)
+	}
+	if fromID == toID {
+		return fmt.Errorf("%w %s", ErrSameAccount, fromID)
+	}
+
+	recorded := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.IdempotencyKey{Key: idempotencyKey})
+	if recorded.Error != nil {
+		return recorded.Error
+	}
+	if !db.DryRun && recorded.RowsAffected == 0 {
+		slog.InfoContext(ctx, "Transfer already processed", "key", idempotencyKey)
+		return nil
+	}
+
+	var fromAccount model.Account
+	var toAccount model.Account
+
+	if err := db.Clauses(clause.Locking{Strength: "UPDATE"}).First(&fromAccount, fromID).Error; err != nil {
+		return lookupError(fromID, err)
+	}
+	if err := db.Clauses(clause.Locking{Strength: "UPDATE"}).First(&toAccount, toID).Error; err != nil {
+		return lookupError(toID, err)
+	}
+
+	// The source account may go negative, but not by more than its limit
+	if !db.DryRun && fromAccount.Balance-amount < -fromAccount.OverdraftLimit {
+		return fmt.Errorf("account %s balance %s with overdraft limit %s is too low for transfer amount %s: %w", fromID, fromAccount.Balance, fromAccount.OverdraftLimit, amount, ErrInsufficientFunds)
+	}
+	// Comparing with `maxBalance - amount` rather than adding `amount` to the
+	// balance cannot overflow
+	if !db.DryRun && toAccount.Balance > maxBalance-amount {
+		return fmt.Errorf("account %s balance %s plus transfer amount %s is above %s: %w", toID, toAccount.Balance, amount, maxBalance, ErrBalanceLimit)
+	}
+
+	if err := updateBalance(db, fromAccount, fromID, gorm.Expr("balance - ?", amount)); err != nil {
+		return err
+	}
+	if err := updateBalance(db, toAccount, toID, gorm.Expr("balance + ?", amount)); err != nil {
+		return err
+	}
+
+	// Record the transfer in the same transaction as the balance updates,
+	// so the ledger always matches the balances
+	if err := db.Create(&model.Transfer{ID: uuid.New(), FromID: fromID, ToID: toID, Amount: amount}).Error; err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Funds transferred", "amount", amount.String(), "from", fromID, "to", toID)
+	return nil
+}
+
+// TransferPercent moves `pct` percent of the current balance of `fromID` to
+// `toID`, and returns the amount moved
+// The balance is read inside the transaction, with SELECT ... FOR UPDATE, so
+// the amount is computed from live data: a concurrent transfer that changes
+// the balance first makes this transaction wait, or retry, rather than move
+// a stale share. The amount is rounded down to whole cents
+func TransferPercent(ctx context.Context, db *gorm.DB, idempotencyKey string, fromID uuid.UUID, toID uuid.UUID, pct float64, maxBalance model.Money) (model.Money, error) {
+	if !(pct > 0 && pct <= 100) {
+		return 0, fmt.Errorf("%w: the percentage must be greater than 0 and at most 100, got %v", ErrInvalidAmount, pct)
+	}
+	var fromAccount model.Account
+	if err := db.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(&fromAccount, fromID).Error; err != nil {
+		return 0, lookupError(fromID, err)
+	}
+	amount := model.Money(math.Floor(float64(fromAccount.Balance) * pct / 100))
+	return amount, TransferFunds(ctx, db, idempotencyKey, fromID, toID, amount, maxBalance)
+}
+
+// TransferRequest describes one leg of a batch of transfers
+type TransferRequest struct {
+	From   uuid.UUID
+	To     uuid.UUID
+	Amount model.Money
+}
+
+// TransferBatch applies all the transfers in `transfers`, in order, within a
+// single transaction
+// The legs commit together or not at all: if any leg is a self-transfer, has a
+// non-positive amount, or finds too little money in its source account (taking
+// the earlier legs into account), the whole batch is rolled back
+// The transaction runs with `opts`, and the number of times it ran is
+// returned along with any error. A large batch holds its locks until it
+// commits, so it is more likely to conflict, and be retried, than a single
+// transfer
+// Every leg is counted in the transfer metrics, with the outcome of the batch
+func TransferBatch(ctx context.Context, db *gorm.DB, opts *sql.TxOptions, transfers []TransferRequest, maxBalance model.Money) (int, error) {
+	for i, t := range transfers {
+		if t.From == t.To {
+			return 0, fmt.Errorf("transfer %d: %w %s", i, ErrSameAccount, t.From)
+		}
+		if t.Amount <= 0 {
+			return 0, fmt.Errorf("transfer %d: %w, got %s", i, ErrInvalidAmount, t.Amount)
+		}
+	}
+
+	// The keys are created outside of the retry loop, so every attempt
+	// refers to the same requests
+	keys := make([]string, len(transfers))
+	for i := range keys {
+		keys[i] = uuid.NewString()
+	}
+	var attempts int
+	err := observeTransfers(len(transfers), func() (err error) {
+		attempts, err = ExecuteTx(ctx, db, opts,
+			func(tx *gorm.DB) error {
+				for i, t := range transfers {
+					if err := TransferFunds(ctx, tx, keys[i], t.From, t.To, t.Amount, maxBalance); err != nil {
+						return fmt.Errorf("transfer %d: %w", i, err)
+					}
+				}
+				return nil
+			},
+		)
+		return err
+	})
+	return attempts, err
+}
+
+// versionConflictError is returned when an account row no longer has the
+// version it had when it was read
+// It reports SQLSTATE 40001 (serialization_failure), the same code CockroachDB
+// uses for transaction conflicts, so `crdbgorm.ExecuteTx` retries the transaction
+type versionConflictError struct {
+	id uuid.UUID
+}
+
+func (e *versionConflictError) Error() string {
+	return fmt.Sprintf("account %s was modified concurrently", e.id)
+}
+
+// SQLState is the method `crdbgorm.ExecuteTx` looks for to decide whether
+// an error can be retried
+func (e *versionConflictError) SQLState() string {
+	return "40001"
+}
+
+// Set the balance of the account with ID `id` to `balance`, and increment its
+// version, but only if the row is still at the version found in `account`
+// This is optimistic concurrency control: a concurrent writer that got there
+// first has already incremented the version, so no row matches
+func updateBalance(db *gorm.DB, account model.Account, id uuid.UUID, balance clause.Expr) error {
+	result := db.Model(&model.Account{}).
+		Where("id = ? AND version = ?", id, account.Version).
+		Updates(map[string]interface{}{"balance": balance, "version": gorm.Expr("version + 1")})
+	if isCheckViolation(result.Error) {
+		return fmt.Errorf("account %s: %w: %w", id, ErrInsufficientFunds, result.Error)
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if !db.DryRun && result.RowsAffected == 0 {
+		return &versionConflictError{id: id}
+	}
+	return nil
+}
+
+// Report whether `err` is a CHECK constraint violation (SQLSTATE 23514), such
+// as an UPDATE that would break "balance_within_overdraft"
+// Such errors are not retried by `crdbgorm.ExecuteTx`, since running the same
+// statements again would fail the same way
+func isCheckViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23514"
+}
+
+// ExecuteTx runs `fn` in a transaction with `crdbgorm.ExecuteTx`, and returns
+// how many times it ran
+// `crdbgorm.ExecuteTx` runs `fn` again every time CockroachDB asks for the
+// transaction to be retried, so the count shows how much contention there was.
+// It is also recorded in the transaction attempts histogram
+func ExecuteTx(ctx context.Context, db *gorm.DB, opts *sql.TxOptions, fn func(tx *gorm.DB) error) (int, error) {
+	attempts := 0
+	err := crdbgorm.ExecuteTx(ctx, db, opts,
+		func(tx *gorm.DB) error {
+			attempts++
+			return fn(tx)
+		},
+	)
+	txAttempts.Observe(float64(attempts))
+	if attempts > 1 {
+		slog.DebugContext(ctx, "Transaction retried", "attempts", attempts)
+	}
+	return attempts, err
+}
+
+// ExecuteTransfer runs `fn`, which makes one transfer, in a transaction with
+// `ExecuteTx`, and returns how many times it ran
+// The transfer is counted once in the transfer metrics, however many times
+// it is retried, and its latency covers every attempt and the commit
+func ExecuteTransfer(ctx context.Context, db *gorm.DB, opts *sql.TxOptions, fn func(tx *gorm.DB) error) (int, error) {
+	var attempts int
+	err := observeTransfers(1, func() (err error) {
+		attempts, err = ExecuteTx(ctx, db, opts, fn)
+		return err
+	})
+	return attempts, err
+}
+
+// Run `transaction`, which makes `n` transfers, counting them in the
+// transfer metrics by its outcome
+func observeTransfers(n int, transaction func() error) error {
+	transfersAttempted.Add(float64(n))
+	start := time.Now()
+	err := transaction()
+	transferDuration.Observe(time.Since(start).Seconds())
+	switch {
+	case err == nil:
+		transfersSucceeded.Add(float64(n))
+	case IsRejected(err):
+		transfersFailed.WithLabelValues("rejected").Add(float64(n))
+	default:
+		transfersFailed.WithLabelValues("error").Add(float64(n))
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+//go:build integration
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The signature shared by the transfer variants
+type transferFunc func(ctx context.Context, db *gorm.DB, idempotencyKey string, fromID uuid.UUID, toID uuid.UUID, amount model.Money, maxBalance model.Money) error
+
+// The transfer variants the benchmarks compare:
+//   - "ReadModifyWrite" reads both accounts without locking them, and writes
+//     back the balances it computed, so a concurrent transfer in between makes
+//     CockroachDB retry the transaction
+//   - "ConditionalUpdate" changes each balance with one atomic UPDATE, and
+//     checks the funds and the balance cap in their WHERE clauses instead of
+//     reading the accounts first
+//   - "ForUpdate" is `TransferFunds`, which locks both accounts with
+//     SELECT ... FOR UPDATE, checks them, and updates them with a version
+//     check
+//   - "Returning" is `TransferFundsReturning`, which changes both in one
+//     statement and checks the balances it returns
+//
+// The first two exist only for the comparison. Like `TransferFunds`, they
+// record the idempotency key and log the transfer, so that every variant
+// runs the same number of writes besides the balance changes
+var transferVariants = []struct {
+	name     string
+	transfer transferFunc
+}{
+	{"ReadModifyWrite", readModifyWriteTransfer},
+	{"ConditionalUpdate", conditionalUpdateTransfer},
+	{"ForUpdate", TransferFunds},
+	{"Returning", TransferFundsReturning},
+}
+
+// Move `amount` from `fromID` to `toID` by reading both balances and writing
+// back the new ones
+func readModifyWriteTransfer(ctx context.Context, db *gorm.DB, idempotencyKey string, fromID uuid.UUID, toID uuid.UUID, amount model.Money, maxBalance model.Money) error {
+	db = db.WithContext(ctx)
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.IdempotencyKey{Key: idempotencyKey}).Error; err != nil {
+		return err
+	}
+	var fromAccount, toAccount model.Account
+	if err := db.First(&fromAccount, fromID).Error; err != nil {
+		return lookupError(fromID, err)
+	}
+	if err := db.First(&toAccount, toID).Error; err != nil {
+		return lookupError(toID, err)
+	}
+	if fromAccount.Balance+fromAccount.OverdraftLimit < amount {
+		return fmt.Errorf("account %s: %w", fromID, ErrInsufficientFunds)
+	}
+	if toAccount.Balance+amount > maxBalance {
+		return fmt.Errorf("account %s: %w", toID, ErrBalanceLimit)
+	}
+	if err := db.Model(&fromAccount).Update("balance", fromAccount.Balance-amount).Error; err != nil {
+		return err
+	}
+	if err := db.Model(&toAccount).Update("balance", toAccount.Balance+amount).Error; err != nil {
+		return err
+	}
+	return db.Create(&model.Transfer{ID: uuid.New(), FromID: fromID, ToID: toID, Amount: amount}).Error
+}
+
+// Move `amount` from `fromID` to `toID` with one conditional UPDATE per
+// account, without reading either of them
+func conditionalUpdateTransfer(ctx context.Context, db *gorm.DB, idempotencyKey string, fromID uuid.UUID, toID uuid.UUID, amount model.Money, maxBalance model.Money) error {
+	db = db.WithContext(ctx)
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.IdempotencyKey{Key: idempotencyKey}).Error; err != nil {
+		return err
+	}
+	debited := db.Model(&model.Account{}).Where("id = ? AND balance + overdraft_limit >= ?", fromID, amount).
+		Update("balance", gorm.Expr("balance - ?", amount))
+	if debited.Error != nil {
+		return debited.Error
+	}
+	if debited.RowsAffected == 0 {
+		return fmt.Errorf("account %s: %w", fromID, ErrInsufficientFunds)
+	}
+	credited := db.Model(&model.Account{}).Where("id = ? AND balance + ? <= ?", toID, amount, maxBalance).
+		Update("balance", gorm.Expr("balance + ?", amount))
+	if credited.Error != nil {
+		return credited.Error
+	}
+	if credited.RowsAffected == 0 {
+		return fmt.Errorf("account %s is missing or would exceed the maximum: %w", toID, ErrBalanceLimit)
+	}
+	return db.Create(&model.Transfer{ID: uuid.New(), FromID: fromID, ToID: toID, Amount: amount}).Error
+}
+
+// Compare the transfer variants against the cluster named by
+// `testDatabaseEnv`, reporting ns/op and the transaction retries per transfer
+// Each iteration moves a cent back and forth between two accounts, in a
+// transaction of its own. The "serial" runs show the cost of the round
+// trips, and the "contended" runs, where every goroutine moves funds between
+// the same two accounts, how often each variant has to be retried
+func BenchmarkTransferVariants(b *testing.B) {
+	db := openTestDB(b)
+	for _, v := range transferVariants {
+		b.Run(v.name+"/serial", func(b *testing.B) {
+			ids := createTestAccounts(b, db, model.Dollars(100), model.Dollars(100))
+			retries := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				retries += benchmarkTransfer(b, db, v.transfer, ids[i%2], ids[1-i%2])
+			}
+			b.ReportMetric(float64(retries)/float64(b.N), "retries/op")
+		})
+		b.Run(v.name+"/contended", func(b *testing.B) {
+			ids := createTestAccounts(b, db, model.Dollars(100), model.Dollars(100))
+			var retries atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					retries.Add(int64(benchmarkTransfer(b, db, v.transfer, ids[i%2], ids[1-i%2])))
+				}
+			})
+			b.ReportMetric(float64(retries.Load())/float64(b.N), "retries/op")
+		})
+	}
+}
+
+// Move a cent from `fromID` to `toID` with `transfer`, in a transaction of its
+// own, and return how many times the transaction was retried
+func benchmarkTransfer(b *testing.B, db *gorm.DB, transfer transferFunc, fromID uuid.UUID, toID uuid.UUID) int {
+	ctx := context.Background()
+	key := uuid.NewString()
+	attempts, err := ExecuteTx(ctx, db, nil, func(tx *gorm.DB) error {
+		return transfer(ctx, tx, key, fromID, toID, 1, DefaultMaxBalance)
+	})
+	if err != nil {
+		b.Error(err)
+	}
+	return max(attempts-1, 0)
+}
+
+// Compare transfers with and without GORM's prepared statement cache, which
+// the `-prepare-stmt` flag turns on
+// With the cache, each connection prepares every statement once, and later
+// transfers only send the parameters. Without it, every statement is sent
+// as text, and parsed again
+func BenchmarkTransferPrepareStmt(b *testing.B) {
+	db := openTestDB(b)
+	for _, prepare := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prepare=%v", prepare), func(b *testing.B) {
+			session := db.Session(&gorm.Session{PrepareStmt: prepare})
+			ids := createTestAccounts(b, db, model.Dollars(100), model.Dollars(100))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				benchmarkTransfer(b, session, TransferFunds, ids[i%2], ids[1-i%2])
+			}
+		})
+	}
+}
+
+// Compare inserting 50,000 accounts one row per INSERT, as the example did
+// before it used batches, with multi-row INSERTs of 1,000 rows each
+// Every statement is a round trip to the cluster, so the batches save all
+// but 50 of the 50,000 round trips
+func BenchmarkAddAccounts(b *testing.B) {
+	db := openTestDB(b)
+	ctx := context.Background()
+	const rows = 50_000
+	for _, batchSize := range []int{1, 1000} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(1))
+			for i := 0; i < b.N; i++ {
+				ids, err := AddAccounts(ctx, db, NewAccounts(rng, rows, 100, 10100, 0, nil), batchSize, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				if _, err := ExecuteTx(ctx, db, nil, func(tx *gorm.DB) error {
+					return DeleteAccounts(ctx, tx, ids, true)
+				}); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(rows)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
@@ -0,0 +1,392 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// The statements `TransferFunds` runs, in order, as GORM generates them
+const (
+	insertKeySQL      = `INSERT INTO "transfer_requests" ("key","created_at") VALUES ($1,$2) ON CONFLICT DO NOTHING`
+	lockAccountSQL    = `SELECT * FROM "accounts" WHERE "accounts"."id" = $1 AND "accounts"."deleted_at" IS NULL ORDER BY "accounts"."id" LIMIT $2 FOR UPDATE`
+	debitSQL          = `UPDATE "accounts" SET "balance"=balance - $1,"version"=version + 1,"updated_at"=$2 WHERE (id = $3 AND version = $4) AND "accounts"."deleted_at" IS NULL`
+	creditSQL         = `UPDATE "accounts" SET "balance"=balance + $1,"version"=version + 1,"updated_at"=$2 WHERE (id = $3 AND version = $4) AND "accounts"."deleted_at" IS NULL`
+	insertTransferSQL = `INSERT INTO "transfers" ("from_id","to_id","amount","created_at","id") VALUES ($1,$2,$3,$4,$5) RETURNING "id"`
+)
+
+// Open a `*gorm.DB` on a mock connection, which expects exactly the
+// statements set up on the returned `sqlmock.Sqlmock`, in order
+// The test fails if any expected statement did not run
+func newMockDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	sqlDB, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	// The transfers run inside `ExecuteTx`'s transaction, so GORM must not
+	// wrap each statement in one of its own
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{Logger: logger.Discard, SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return db, mock
+}
+
+// The row of an account locked by `TransferFunds`
+func accountRow(id uuid.UUID, balance string, overdraftLimit string, version int) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "balance", "overdraft_limit", "version"}).
+		AddRow(id, balance, overdraftLimit, version)
+}
+
+// Expect `TransferFunds` to record `key` and lock `from` and `to`, with the
+// balances in `fromBalance` and `toBalance`
+func expectLocks(mock sqlmock.Sqlmock, key string, from uuid.UUID, fromBalance string, to uuid.UUID, toBalance string) {
+	mock.ExpectExec(insertKeySQL).WithArgs(key, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(lockAccountSQL).WithArgs(from, 1).WillReturnRows(accountRow(from, fromBalance, "0.00", 3))
+	mock.ExpectQuery(lockAccountSQL).WithArgs(to, 1).WillReturnRows(accountRow(to, toBalance, "0.00", 7))
+}
+
+func TestTransferFunds(t *testing.T) {
+	db, mock := newMockDB(t)
+	from, to := uuid.New(), uuid.New()
+	expectLocks(mock, "key", from, "100.00", to, "50.00")
+	mock.ExpectExec(debitSQL).WithArgs(model.Dollars(30), sqlmock.AnyArg(), from, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(creditSQL).WithArgs(model.Dollars(30), sqlmock.AnyArg(), to, 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(insertTransferSQL).WithArgs(from, to, model.Dollars(30), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+
+	if err := TransferFunds(context.Background(), db, "key", from, to, model.Dollars(30), DefaultMaxBalance); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransferFundsAlreadyProcessed(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectExec(insertKeySQL).WithArgs("key", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := TransferFunds(context.Background(), db, "key", uuid.New(), uuid.New(), model.Dollars(30), DefaultMaxBalance); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransferFundsInsufficientFunds(t *testing.T) {
+	db, mock := newMockDB(t)
+	from, to := uuid.New(), uuid.New()
+	expectLocks(mock, "key", from, "29.99", to, "50.00")
+
+	err := TransferFunds(context.Background(), db, "key", from, to, model.Dollars(30), DefaultMaxBalance)
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("TransferFunds() error = %v, want %v", err, ErrInsufficientFunds)
+	}
+}
+
+func TestTransferFundsSameAccount(t *testing.T) {
+	db, _ := newMockDB(t)
+	id := uuid.New()
+
+	err := TransferFunds(context.Background(), db, "key", id, id, model.Dollars(30), DefaultMaxBalance)
+	if !errors.Is(err, ErrSameAccount) {
+		t.Fatalf("TransferFunds() error = %v, want %v", err, ErrSameAccount)
+	}
+}
+
+func TestTransferFundsSourceNotFound(t *testing.T) {
+	db, mock := newMockDB(t)
+	from, to := uuid.New(), uuid.New()
+	mock.ExpectExec(insertKeySQL).WithArgs("key", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(lockAccountSQL).WithArgs(from, 1).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	err := TransferFunds(context.Background(), db, "key", from, to, model.Dollars(30), DefaultMaxBalance)
+	if !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("TransferFunds() error = %v, want %v", err, ErrAccountNotFound)
+	}
+}
+
+func TestTransferFundsSameAccountKeepsBalance(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	ids := createTestAccounts(t, db, model.Dollars(100))
+
+	_, err := ExecuteTx(ctx, db, nil, func(tx *gorm.DB) error {
+		return TransferFunds(ctx, tx, uuid.NewString(), ids[0], ids[0], model.Dollars(30), DefaultMaxBalance)
+	})
+	if !errors.Is(err, ErrSameAccount) {
+		t.Fatalf("TransferFunds() error = %v, want %v", err, ErrSameAccount)
+	}
+	if got := testBalance(t, db, ids[0]); got != model.Dollars(100) {
+		t.Errorf("balance = %s, want it unchanged at %s", got, model.Dollars(100))
+	}
+}
+
+func TestConcurrentTransfersConserveTotal(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	ids := createTestAccounts(t, db, model.Dollars(100), model.Dollars(100))
+
+	// Two goroutines move funds in opposite directions at once, so each
+	// transfer locks the rows the other one needs
+	const transfers = 10
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, pair := range [][2]uuid.UUID{{ids[0], ids[1]}, {ids[1], ids[0]}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < transfers && errs[i] == nil; n++ {
+				key := uuid.NewString()
+				_, errs[i] = ExecuteTx(ctx, db, nil, func(tx *gorm.DB) error {
+					return TransferFunds(ctx, tx, key, pair[0], pair[1], model.Dollars(i+1), DefaultMaxBalance)
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first goroutine moved $1 and the second $2 each time
+	want := [2]model.Money{model.Dollars(100 + transfers), model.Dollars(100 - transfers)}
+	for i, id := range ids {
+		if got := testBalance(t, db, id); got != want[i] {
+			t.Errorf("balance of account %d = %s, want %s", i, got, want[i])
+		}
+	}
+}
+
+func TestSaveOverdrawnAccountRejected(t *testing.T) {
+	// No statement is expected, so the mock fails the test if the hook lets
+	// the UPDATE through
+	db, _ := newMockDB(t)
+	account := model.Account{ID: uuid.New(), Balance: -1, Version: 3}
+
+	if err := db.Save(&account).Error; err == nil {
+		t.Fatal("Save() of an overdrawn account succeeded, want the BeforeSave hook to reject it")
+	}
+}
+
+func TestTransferFundsVersionConflictRetried(t *testing.T) {
+	db, mock := newMockDB(t)
+	ctx := context.Background()
+	from, to := uuid.New(), uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectExec("SAVEPOINT cockroach_restart").WillReturnResult(sqlmock.NewResult(0, 0))
+	// The first attempt finds the source at version 3, but a concurrent
+	// writer has moved it on by the time of the UPDATE, which matches no row
+	expectLocks(mock, "key", from, "100.00", to, "50.00")
+	mock.ExpectExec(debitSQL).WithArgs(model.Dollars(30), sqlmock.AnyArg(), from, 3).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT cockroach_restart").WillReturnResult(sqlmock.NewResult(0, 0))
+	// The retry reads the new version, and goes through
+	mock.ExpectExec(insertKeySQL).WithArgs("key", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(lockAccountSQL).WithArgs(from, 1).WillReturnRows(accountRow(from, "90.00", "0.00", 4))
+	mock.ExpectQuery(lockAccountSQL).WithArgs(to, 1).WillReturnRows(accountRow(to, "50.00", "0.00", 7))
+	mock.ExpectExec(debitSQL).WithArgs(model.Dollars(30), sqlmock.AnyArg(), from, 4).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(creditSQL).WithArgs(model.Dollars(30), sqlmock.AnyArg(), to, 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(insertTransferSQL).WithArgs(from, to, model.Dollars(30), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+	mock.ExpectExec("RELEASE SAVEPOINT cockroach_restart").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	attemptedBefore, succeededBefore := testutil.ToFloat64(transfersAttempted), testutil.ToFloat64(transfersSucceeded)
+	attempts, err := ExecuteTransfer(ctx, db, nil, func(tx *gorm.DB) error {
+		return TransferFunds(ctx, tx, "key", from, to, model.Dollars(30), DefaultMaxBalance)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("ExecuteTransfer() ran %d attempts, want 2", attempts)
+	}
+	// The retry is still one transfer
+	if got := testutil.ToFloat64(transfersAttempted) - attemptedBefore; got != 1 {
+		t.Errorf("transfers attempted went up by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(transfersSucceeded) - succeededBefore; got != 1 {
+		t.Errorf("transfers succeeded went up by %v, want 1", got)
+	}
+}
+
+func TestRacingTransfersFromOneAccount(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	ids := createTestAccounts(t, db, model.Dollars(100), 0, 0)
+
+	// Both goroutines debit the first account, so without the row lock and
+	// the version check one of them could overwrite the other's debit
+	const transfers = 10
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < transfers && errs[i] == nil; n++ {
+				key := uuid.NewString()
+				_, errs[i] = ExecuteTx(ctx, db, nil, func(tx *gorm.DB) error {
+					return TransferFunds(ctx, tx, key, ids[0], ids[i+1], model.Dollars(1), DefaultMaxBalance)
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := testBalance(t, db, ids[0]), model.Dollars(100-2*transfers); got != want {
+		t.Errorf("source balance = %s, want %s after every debit", got, want)
+	}
+}
+
+func TestIsCheckViolation(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"check violation", &pgconn.PgError{Code: "23514"}, true},
+		{"wrapped check violation", fmt.Errorf("updating: %w", &pgconn.PgError{Code: "23514"}), true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"no error", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isCheckViolation(tt.err); got != tt.want {
+				t.Errorf("isCheckViolation(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransferFundsCheckViolation(t *testing.T) {
+	// The balance read passes the check in Go, but the constraint fails the
+	// UPDATE, as it would if the row changed in between
+	db, mock := newMockDB(t)
+	from, to := uuid.New(), uuid.New()
+	expectLocks(mock, "key", from, "100.00", to, "50.00")
+	mock.ExpectExec(debitSQL).WithArgs(model.Dollars(30), sqlmock.AnyArg(), from, 3).
+		WillReturnError(&pgconn.PgError{Code: "23514", ConstraintName: "balance_within_overdraft"})
+
+	err := TransferFunds(context.Background(), db, "key", from, to, model.Dollars(30), DefaultMaxBalance)
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("TransferFunds() error = %v, want %v", err, ErrInsufficientFunds)
+	}
+}
+
+func TestBalanceConstraint(t *testing.T) {
+	db := openTestDB(t)
+	ids := createTestAccounts(t, db, model.Dollars(100))
+
+	// The UPDATE is computed in SQL, so the BeforeSave hook cannot see it,
+	// and only the CHECK constraint stands in the way
+	err := db.Model(&model.Account{}).Where("id = ?", ids[0]).Update("balance", gorm.Expr("balance - ?", model.Dollars(101))).Error
+	if !isCheckViolation(err) {
+		t.Fatalf("overdrawing UPDATE error = %v, want a CHECK constraint violation", err)
+	}
+	if got := testBalance(t, db, ids[0]); got != model.Dollars(100) {
+		t.Errorf("balance = %s, want it unchanged at %s", got, model.Dollars(100))
+	}
+}
+
+func TestTransferFundsNonPositiveAmount(t *testing.T) {
+	for _, amount := range []model.Money{0, -1, model.Dollars(-30)} {
+		t.Run(amount.String(), func(t *testing.T) {
+			// No statement is expected, so no balance can change
+			db, _ := newMockDB(t)
+
+			err := TransferFunds(context.Background(), db, "key", uuid.New(), uuid.New(), amount, DefaultMaxBalance)
+			if !errors.Is(err, ErrInvalidAmount) {
+				t.Fatalf("TransferFunds() error = %v, want %v", err, ErrInvalidAmount)
+			}
+		})
+	}
+}
+
+func TestTransferFundsOverdraftBoundary(t *testing.T) {
+	tests := []struct {
+		name    string
+		balance string
+		limit   string
+		amount  model.Money
+		wantErr error
+	}{
+		{"down to zero without a limit", "30.00", "0.00", model.Dollars(30), nil},
+		{"a cent below zero without a limit", "30.00", "0.00", model.Dollars(30) + 1, ErrInsufficientFunds},
+		{"down to the limit", "10.00", "20.00", model.Dollars(30), nil},
+		{"a cent past the limit", "10.00", "20.00", model.Dollars(30) + 1, ErrInsufficientFunds},
+		{"already overdrawn, within the limit", "-10.00", "20.00", model.Dollars(10), nil},
+		{"already overdrawn, past the limit", "-10.00", "20.00", model.Dollars(10) + 1, ErrInsufficientFunds},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			from, to := uuid.New(), uuid.New()
+			mock.ExpectExec(insertKeySQL).WithArgs("key", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(lockAccountSQL).WithArgs(from, 1).WillReturnRows(accountRow(from, tt.balance, tt.limit, 3))
+			mock.ExpectQuery(lockAccountSQL).WithArgs(to, 1).WillReturnRows(accountRow(to, "0.00", "0.00", 7))
+			if tt.wantErr == nil {
+				mock.ExpectExec(debitSQL).WithArgs(tt.amount, sqlmock.AnyArg(), from, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(creditSQL).WithArgs(tt.amount, sqlmock.AnyArg(), to, 7).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(insertTransferSQL).WithArgs(from, to, tt.amount, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+			}
+
+			err := TransferFunds(context.Background(), db, "key", from, to, tt.amount, DefaultMaxBalance)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("TransferFunds() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTransferFundsBalanceCap(t *testing.T) {
+	maxBalance := model.Dollars(1000)
+	tests := []struct {
+		name    string
+		amount  model.Money
+		wantErr error
+	}{
+		{"up to the cap", model.Dollars(100), nil},
+		{"a cent over the cap", model.Dollars(100) + 1, ErrBalanceLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			from, to := uuid.New(), uuid.New()
+			expectLocks(mock, "key", from, "500.00", to, "900.00")
+			if tt.wantErr == nil {
+				mock.ExpectExec(debitSQL).WithArgs(tt.amount, sqlmock.AnyArg(), from, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(creditSQL).WithArgs(tt.amount, sqlmock.AnyArg(), to, 7).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(insertTransferSQL).WithArgs(from, to, tt.amount, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+			}
+
+			err := TransferFunds(context.Background(), db, "key", from, to, tt.amount, maxBalance)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("TransferFunds() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachlabs/example-app-go-gorm/model"
+	"github.com/cockroachlabs/example-app-go-gorm/store"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Create the random number generator for balances and transfer destinations
+// A `seed` of 0 is replaced with a time-based seed. The seed is logged either
+// way, so that a run can be reproduced
+func newRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	slog.Info("Using random seed", "seed", seed)
+	return rand.New(rand.NewSource(seed))
+}
+
+// Select the source and destination accounts for the demo transfer
+// The source is always the first account, and the destination is drawn from
+// `rng` among the others
+// `runDemo` requires `-min-balance` to be at least `-amount`, so every new
+// account, the source included, can cover the first transfer, and the happy
+// path of the demo always succeeds
+// With fewer than two accounts, the source would also be the destination,
+// which is an error
+func selectAccounts(rng *rand.Rand, acctIDs []uuid.UUID) (uuid.UUID, uuid.UUID, error) {
+	if len(acctIDs) < 2 {
+		return uuid.Nil, uuid.Nil, fmt.Errorf("need at least two accounts to transfer between, got %d", len(acctIDs))
+	}
+	return acctIDs[0], acctIDs[1:][rng.Intn(len(acctIDs)-1)], nil
+}
+
+// Draw a transfer of a random whole-dollar amount, from one dollar up to
+// `maxAmount`, between two distinct accounts in `acctIDs`
+func randomTransfer(rng *rand.Rand, acctIDs []uuid.UUID, maxAmount model.Money) store.TransferRequest {
+	from := rng.Intn(len(acctIDs))
+	// Draw the destination from the other accounts, so that it is never
+	// the source
+	to := rng.Intn(len(acctIDs) - 1)
+	if to >= from {
+		to++
+	}
+	return store.TransferRequest{From: acctIDs[from], To: acctIDs[to], Amount: model.Dollars(1 + rng.Intn(int(maxAmount/100)))}
+}
+
+// Run `count` random transfers between the accounts in `acctIDs`, one after
+// another
+// Each transfer moves a random whole-dollar amount, from one dollar up to
+// `maxAmount`, between two distinct accounts, in its own `store.ExecuteTransfer`.
+// Transfers that the store rejects, such as those that find too little money
+// in their source account or would push the destination past `maxBalance`, are
+// counted separately and do not fail the run, since random transfers
+// eventually drain some accounts
+// The total number of transaction attempts is returned along with any error
+func randomTransfers(ctx context.Context, db *gorm.DB, txOpts *sql.TxOptions, rng *rand.Rand, acctIDs []uuid.UUID, count int, maxAmount model.Money, maxBalance model.Money) (int, error) {
+	if len(acctIDs) < 2 {
+		return 0, fmt.Errorf("random transfers need at least 2 accounts, got %d", len(acctIDs))
+	}
+	slog.InfoContext(ctx, "Starting random transfers", "count", count, "max_amount", maxAmount.String())
+
+	attempts, succeeded, rejected, failed := 0, 0, 0, 0
+	for i := 0; i < count && ctx.Err() == nil; i++ {
+		t := randomTransfer(rng, acctIDs, maxAmount)
+		key := uuid.NewString()
+		n, err := store.ExecuteTransfer(ctx, db, txOpts,
+			func(tx *gorm.DB) error {
+				return store.TransferFunds(ctx, tx, key, t.From, t.To, t.Amount, maxBalance)
+			},
+		)
+		attempts += n
+		switch {
+		case err == nil:
+			succeeded++
+		case store.IsRejected(err):
+			rejected++
+		default:
+			failed++
+			slog.WarnContext(ctx, "Transfer failed", "error", err)
+		}
+	}
+	slog.InfoContext(ctx, "Random transfers finished", "succeeded", succeeded, "rejected", rejected, "failed", failed)
+	if failed > 0 {
+		return attempts, fmt.Errorf("%d of %d random transfers failed", failed, count)
+	}
+	return attempts, ctx.Err()
+}
+
+// Run `count` random transfers between the accounts in `acctIDs`, all in one
+// transaction with `store.TransferBatch`
+// Unlike `randomTransfers`, the transfers commit together or not at all, so a
+// single one that finds too little money rolls back the whole batch. Whether
+// the batch committed, and after how many attempts, is logged
+// The number of transaction attempts is returned along with any error
+func batchTransfers(ctx context.Context, db *gorm.DB, txOpts *sql.TxOptions, rng *rand.Rand, acctIDs []uuid.UUID, count int, maxAmount model.Money, maxBalance model.Money) (int, error) {
+	if len(acctIDs) < 2 {
+		return 0, fmt.Errorf("random transfers need at least 2 accounts, got %d", len(acctIDs))
+	}
+	slog.InfoContext(ctx, "Starting a batch of random transfers in one transaction", "count", count, "max_amount", maxAmount.String())
+	transfers := make([]store.TransferRequest, count)
+	for i := range transfers {
+		transfers[i] = randomTransfer(rng, acctIDs, maxAmount)
+	}
+	attempts, err := store.TransferBatch(ctx, db, txOpts, transfers, maxBalance)
+	if err != nil {
+		slog.WarnContext(ctx, "Transfer batch rolled back", "count", count, "attempts", attempts, "error", err)
+		return attempts, err
+	}
+	slog.InfoContext(ctx, "Transfer batch committed", "count", count, "attempts", attempts, "retried", attempts > 1)
+	return attempts, nil
+}
+
+// Run random transfers of `amount` between the accounts in `acctIDs` from
+// `workers` goroutines at once, until `duration` has passed
+// Every transfer is wrapped in `store.ExecuteTransfer`, so the transactions that conflict
+// with each other are retried. Each worker draws accounts from its own
+// generator, seeded from `rng`, because `rand.Rand` is not safe for concurrent use
+// Every transaction runs with `txOpts`
+// Every `poolStatsEvery`, unless it is 0, the connection pool statistics are
+// logged, so that it shows when the workers wait for connections more than
+// for the database. The total wait is logged at the end either way
+// The total number of transaction attempts is returned along with any error
+func concurrentTransfers(ctx context.Context, db *gorm.DB, txOpts *sql.TxOptions, rng *rand.Rand, acctIDs []uuid.UUID, workers int, duration time.Duration, amount model.Money, maxBalance model.Money, poolStatsEvery time.Duration) (int, error) {
+	if len(acctIDs) < 2 {
+		return 0, fmt.Errorf("concurrent transfers need at least 2 accounts, got %d", len(acctIDs))
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return 0, err
+	}
+	slog.InfoContext(ctx, "Starting concurrent transfers", "workers", workers, "duration", duration)
+	if maxOpen := sqlDB.Stats().MaxOpenConnections; maxOpen > 0 && workers > maxOpen {
+		slog.WarnContext(ctx, "More workers than connections, so some will wait for a connection", "workers", workers, "max_open_conns", maxOpen)
+	}
+
+	poolBefore := sqlDB.Stats()
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	if poolStatsEvery > 0 {
+		go logPoolStats(ctx, sqlDB, poolStatsEvery)
+	}
+
+	var wg sync.WaitGroup
+	var attempted, txAttempts atomic.Int64
+	errs := make(chan error)
+	for i := 0; i < workers; i++ {
+		workerRng := rand.New(rand.NewSource(rng.Int63()))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				from := workerRng.Intn(len(acctIDs))
+				to := workerRng.Intn(len(acctIDs) - 1)
+				if to >= from {
+					to++
+				}
+				attempted.Add(1)
+				key := uuid.NewString()
+				n, err := store.ExecuteTransfer(ctx, db, txOpts,
+					func(tx *gorm.DB) error {
+						return store.TransferFunds(ctx, tx, key, acctIDs[from], acctIDs[to], amount, maxBalance)
+					},
+				)
+				txAttempts.Add(int64(n))
+				if err != nil && ctx.Err() == nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(errs)
+	}()
+
+	// Random transfers eventually drain some accounts, so transfers that are
+	// rejected for insufficient funds are expected and do not fail the run
+	failed, rejected := 0, 0
+	for err := range errs {
+		if store.IsRejected(err) {
+			rejected++
+			slog.InfoContext(ctx, "Transfer rejected", "error", err)
+			continue
+		}
+		failed++
+		slog.WarnContext(ctx, "Transfer failed", "error", err)
+	}
+	poolAfter := sqlDB.Stats()
+	slog.InfoContext(ctx, "Concurrent transfers finished", "attempted", attempted.Load(), "rejected", rejected, "failed", failed,
+		"pool_waits", poolAfter.WaitCount-poolBefore.WaitCount, "pool_wait_time", poolAfter.WaitDuration-poolBefore.WaitDuration)
+	if failed > 0 {
+		return int(txAttempts.Load()), fmt.Errorf("%d of %d concurrent transfers failed", failed, attempted.Load())
+	}
+	return int(txAttempts.Load()), nil
+}
+
+// Log the statistics of the connection pool of `sqlDB` every `every`, until
+// `ctx` is done
+// The waits are counted since the previous message, so a growing wait time
+// means the pool, sized by `-max-open-conns`, is what limits the throughput
+func logPoolStats(ctx context.Context, sqlDB *sql.DB, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	last := sqlDB.Stats()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stats := sqlDB.Stats()
+		waits := stats.WaitCount - last.WaitCount
+		waited := stats.WaitDuration - last.WaitDuration
+		level := slog.LevelInfo
+		if waits > 0 {
+			level = slog.LevelWarn
+		}
+		slog.Log(ctx, level, "Connection pool", "open", stats.OpenConnections, "in_use", stats.InUse, "idle", stats.Idle, "max_open", stats.MaxOpenConnections, "waits", waits, "wait_time", waited)
+		last = stats
+	}
+}
+
+// Run two transfers of `amount` at once, from `fromID` to `toID` and back,
+// arranged so that they conflict, to show what the retries of
+// `store.ExecuteTx` are for
+// Each transaction first reads both balances, and waits for the other to have
+// done the same before it transfers. Whichever commits second has read rows
+// that the first one changed, so CockroachDB aborts it with a serialization
+// error (SQLSTATE 40001) and `store.ExecuteTx` runs it again. Only the first
+// attempt waits, so the retry goes through, and it stops waiting when `ctx`
+// is done or the other transaction failed before reading
+// The transfers cancel out, so both balances must end where they started,
+// which is checked. The total number of transaction attempts is returned
+// along with any error
+func contendedTransfers(ctx context.Context, db *gorm.DB, txOpts *sql.TxOptions, fromID uuid.UUID, toID uuid.UUID, amount model.Money, maxBalance model.Money) (int, error) {
+	if fromID == toID {
+		return 0, fmt.Errorf("contending transfers need 2 distinct accounts, got %s twice", fromID)
+	}
+	// The first transaction holds its connection while it waits for the
+	// second, which could never start with a single connection
+	sqlDB, err := db.DB()
+	if err != nil {
+		return 0, err
+	}
+	if maxOpen := sqlDB.Stats().MaxOpenConnections; maxOpen == 1 {
+		return 0, errors.New("contending transfers need at least 2 connections, got -max-open-conns 1")
+	}
+	fromBefore, err := store.GetBalance(ctx, db, fromID)
+	if err != nil {
+		return 0, err
+	}
+	toBefore, err := store.GetBalance(ctx, db, toID)
+	if err != nil {
+		return 0, err
+	}
+	slog.InfoContext(ctx, "Starting two contending transfers", "from", fromID, "to", toID, "amount", amount.String())
+
+	// `read[i]` is closed once transaction `i` has read both balances, or
+	// has given up before it could. Closing it through `signal[i]` in a
+	// defer too means that every way out of the goroutine releases the other
+	// one, which waits for it otherwise
+	var wg sync.WaitGroup
+	read := [2]chan struct{}{make(chan struct{}), make(chan struct{})}
+	var signal [2]sync.Once
+	attempts := make([]int, 2)
+	errs := make([]error, 2)
+	for i, pair := range [][2]uuid.UUID{{fromID, toID}, {toID, fromID}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done := func() { signal[i].Do(func() { close(read[i]) }) }
+			defer done()
+			first := true
+			key := uuid.NewString()
+			attempts[i], errs[i] = store.ExecuteTransfer(ctx, db, txOpts,
+				func(tx *gorm.DB) error {
+					if first {
+						first = false
+						_, err := store.GetBalance(ctx, tx, pair[0])
+						if err == nil {
+							_, err = store.GetBalance(ctx, tx, pair[1])
+						}
+						done()
+						if err != nil {
+							return err
+						}
+						select {
+						case <-read[1-i]:
+						case <-ctx.Done():
+							return ctx.Err()
+						}
+					}
+					return store.TransferFunds(ctx, tx, key, pair[0], pair[1], amount, maxBalance)
+				},
+			)
+		}()
+	}
+	wg.Wait()
+
+	total := attempts[0] + attempts[1]
+	slog.InfoContext(ctx, "Contending transfers finished", "attempts", total, "retries", total-2)
+	if err := errors.Join(errs...); err != nil {
+		return total, err
+	}
+	fromAfter, err := store.GetBalance(ctx, db, fromID)
+	if err != nil {
+		return total, err
+	}
+	toAfter, err := store.GetBalance(ctx, db, toID)
+	if err != nil {
+		return total, err
+	}
+	if fromAfter != fromBefore || toAfter != toBefore {
+		return total, fmt.Errorf("contending transfers changed the balances: %s went from %s to %s, %s from %s to %s", fromID, fromBefore, fromAfter, toID, toBefore, toAfter)
+	}
+	return total, nil
+}
+
+// Run `step` right away and then every `interval`, until `ctx` is cancelled
+// Each run of `step` gets its own context with `timeout`, so the loop can
+// outlast `timeout`. A rejected transfer, e.g. for lack of funds, is printed
+// in the `output` format and the loop goes on; any other error ends it.
+// Being interrupted is how the loop is meant to end, so it is not reported as
+// an error
+// The total number of transaction attempts is returned along with any error
+func repeatTransfers(ctx context.Context, interval time.Duration, timeout time.Duration, output string, step func(ctx context.Context) (int, error)) (int, error) {
+	slog.InfoContext(ctx, "Repeating transfers until interrupted", "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	attempts := 0
+	for cycle := 1; ; cycle++ {
+		stepCtx, cancel := context.WithTimeout(ctx, timeout)
+		n, err := step(stepCtx)
+		cancel()
+		attempts += n
+		if ctx.Err() != nil {
+			slog.InfoContext(ctx, "Stopped repeating transfers", "cycles", cycle)
+			return attempts, nil
+		}
+		if err != nil && !store.IsRejected(err) {
+			return attempts, err
+		}
+		if err != nil {
+			store.PrintError(err, output)
+		}
+		select {
+		case <-ctx.Done():
+			slog.InfoContext(ctx, "Stopped repeating transfers", "cycles", cycle)
+			return attempts, nil
+		case <-ticker.C:
+		}
+	}
+}
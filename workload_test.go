@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSelectAccounts(t *testing.T) {
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	tests := []struct {
+		name     string
+		acctIDs  []uuid.UUID
+		wantFrom uuid.UUID
+		wantErr  bool
+	}{
+		{"no accounts", nil, uuid.Nil, true},
+		{"one account", ids[:1], uuid.Nil, true},
+		{"several accounts", ids, ids[0], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := selectAccounts(newRand(1), tt.acctIDs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectAccounts() error = %v, want error %v", err, tt.wantErr)
+			}
+			if from != tt.wantFrom {
+				t.Errorf("selectAccounts() from = %s, want %s", from, tt.wantFrom)
+			}
+			if !tt.wantErr && to == from {
+				t.Errorf("selectAccounts() picked %s as both source and destination", from)
+			}
+		})
+	}
+}